@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/charmbracelet/huh"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+type (
+	// Command is a subcommand of the CLI, covering a part of the cluster's lifecycle.
+	Command struct {
+		name        string
+		description string
+
+		run func(args []string) error
+	}
+
+	// ConfigFlags are the flags shared by the commands requiring the config file.
+	ConfigFlags struct {
+		configFile   *string
+		templatesDir *string
+		cluster      *string
+	}
+)
+
+var commands = []Command{
+	{name: "init", description: "Generate the config file, interactively", run: runInitConfigWizard},
+	{name: "bootstrap", description: "Bootstrap a new cluster (default)", run: runBootstrapCommand},
+	{name: "render", description: "Only render the cluster dir locally, without touching git or the cluster", run: runRenderCommand},
+	{name: "seal", description: "Seal a Kubernetes Secret for the cluster", run: runSealCommand},
+	{name: "status", description: "Show the sync and health status of the cluster's ArgoCD apps", run: runStatusCommand},
+	{name: "upgrade", description: "Regenerate the files of an existing cluster, and open a PR with the changes", run: runUpgradeCommand},
+	{name: "destroy", description: "Delete the cluster's ArgoCD apps, and open a PR removing its files", run: runDestroyCommand},
+	{name: "version", description: "Print the version of the script", run: runVersionCommand},
+}
+
+// runCommand runs the command specified by the first argument. Without one, the cluster gets
+// bootstrapped, like before the CLI had commands.
+func runCommand(args []string) error {
+	commandName := "bootstrap"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		commandName, args = args[0], args[1:]
+	}
+
+	for _, command := range commands {
+		if command.name == commandName {
+			return command.run(args)
+		}
+	}
+
+	if commandName == "help" {
+		printUsage(os.Stdout)
+		return nil
+	}
+	printUsage(os.Stderr)
+	return errorf(exitCodeConfig, "unknown command %s", commandName)
+}
+
+func printUsage(output io.Writer) {
+	fmt.Fprintln(output, "Usage : kubeaid-bootstrap-script <command> [flags]\n\nCommands :")
+
+	tabWriter := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	for _, command := range commands {
+		fmt.Fprintf(tabWriter, "  %s\t%s\n", command.name, command.description)
+	}
+	tabWriter.Flush()
+
+	fmt.Fprintln(output, "\nRun 'kubeaid-bootstrap-script <command> --help' to see the flags of a command.")
+}
+
+func addConfigFlags(flagSet *flag.FlagSet) *ConfigFlags {
+	return &ConfigFlags{
+		configFile:   flagSet.String("config-file", "", "Path to the YAML config file"),
+		templatesDir: flagSet.String("templates-dir", "", "Dir containing templates, which replace or add to the default ones (mirroring the layout of k8s/cluster)"),
+		cluster:      flagSet.String("cluster", "", "Only handle this cluster, when the config file lists multiple clusters"),
+	}
+}
+
+// load parses the config file and sets up the templates.
+func (c *ConfigFlags) load() error {
+	if err := parseConfigFile(c.configFile); err != nil {
+		return err
+	}
+
+	var err error
+	if templatesFS, err = getTemplatesFS(*c.templatesDir); err != nil {
+		return err
+	}
+
+	if len(*c.cluster) > 0 {
+		i := slices.IndexFunc(clusterConfigs, func(clusterConfig Config) bool {
+			return clusterConfig.ClusterName == *c.cluster
+		})
+		if i == -1 {
+			return errorf(exitCodeConfig, "cluster %s isn't configured in config file %s", *c.cluster, *c.configFile)
+		}
+		clusterConfigs = clusterConfigs[i : i+1]
+		config = clusterConfigs[0]
+	}
+	return nil
+}
+
+// loadSingleCluster is like load, for commands which handle a single cluster.
+func (c *ConfigFlags) loadSingleCluster() error {
+	if err := c.load(); err != nil {
+		return err
+	}
+
+	if len(clusterConfigs) > 1 {
+		return errorf(exitCodeConfig, "config file %s lists multiple clusters (%s). Pick one using --cluster", *c.configFile, strings.Join(getClusterNames(), ", "))
+	}
+	return nil
+}
+
+// parseFlags parses the flags of a command. The flag package has already printed the error and the
+// usage, if the flags are invalid.
+func parseFlags(flagSet *flag.FlagSet, args []string) error {
+	err := flagSet.Parse(args)
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	return errorf(exitCodeConfig, "invalid flags : %w", err)
+}
+
+func runBootstrapCommand(args []string) error {
+	flagSet := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+	configFlags := addConfigFlags(flagSet)
+	flagSet.BoolVar(&dryRun, "dry-run", false, "Only render the cluster directory locally and print it, without touching git or the cluster (same as the render command)")
+	outputDir := flagSet.String("output-dir", "", "Directory to render the files into, in dry-run mode (defaults to a temp dir)")
+	resume := flagSet.Bool("resume", false, "Resume the bootstrap pipeline from the last finished stage")
+	stateFile := flagSet.String("state-file", "", "Path to the file where the bootstrap pipeline's progress is recorded (defaults to ~/.kubeaid/state/<cluster-name>.yaml)")
+	flagSet.DurationVar(&prMergeTimeout, "pr-merge-timeout", 24*time.Hour, "How long to wait for the PR to be merged (0 means waiting forever, which requires prompts to be enabled)")
+	printConfigSchema := flagSet.Bool("print-config-schema", false, "Print the JSON Schema of the config file and exit")
+	addPromptFlags(flagSet)
+	addLogFlags(flagSet)
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+
+	if *printConfigSchema {
+		return printConfigJSONSchema()
+	}
+
+	slog.Info("💫 Running the kubeaid cluster bootstrap script")
+
+	if err := configFlags.load(); err != nil {
+		return err
+	}
+
+	// Nobody would be around to stop the script from waiting forever (for e.g. in a CI pipeline).
+	if !isInteractive() && prMergeTimeout == 0 {
+		return errorf(exitCodeConfig, "--pr-merge-timeout must be greater than 0, when prompts are disabled")
+	}
+
+	// In dry-run mode, we only render the files and print them out. Neither git nor the cluster is
+	// touched.
+	if dryRun {
+		return renderDryRun(*outputDir)
+	}
+
+	// Ensure CLI tools are installed.
+	if err := ensurePrerequisitesInstalled(); err != nil {
+		return err
+	}
+
+	// Run the bootstrap pipeline, resuming from the last checkpoint if asked to.
+	if err := runPipeline(bootstrapPipeline, *stateFile, *resume); err != nil {
+		return err
+	}
+
+	slog.Info("💫 Finished running the kubeaid cluster bootstrap script")
+	return nil
+}
+
+func runRenderCommand(args []string) error {
+	flagSet := flag.NewFlagSet("render", flag.ContinueOnError)
+	configFlags := addConfigFlags(flagSet)
+	outputDir := flagSet.String("output-dir", "", "Directory to render the files into (defaults to a temp dir)")
+	addLogFlags(flagSet)
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+
+	if err := configFlags.load(); err != nil {
+		return err
+	}
+
+	dryRun = true
+	return renderDryRun(*outputDir)
+}
+
+func runSealCommand(args []string) error {
+	flagSet := flag.NewFlagSet("seal", flag.ContinueOnError)
+	configFlags := addConfigFlags(flagSet)
+	secretFile := flagSet.String("file", "-", "Path to the Kubernetes Secret manifest to be sealed ('-' means stdin)")
+	outputFile := flagSet.String("output", "-", "Path where the Sealed Secret manifest gets written ('-' means stdout)")
+	addLogFlags(flagSet)
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+
+	if err := configFlags.loadSingleCluster(); err != nil {
+		return err
+	}
+
+	var (
+		secretManifest []byte
+		err            error
+	)
+	if *secretFile == "-" {
+		secretManifest, err = io.ReadAll(os.Stdin)
+	} else {
+		secretManifest, err = os.ReadFile(*secretFile)
+	}
+	if err != nil {
+		return fmt.Errorf("failed reading Kubernetes Secret manifest : %w", err)
+	}
+
+	// The cluster is only needed, when the Sealed Secrets certificate isn't available locally.
+	var kubeClient *KubeClient
+	if len(config.SealedSecrets.CertFile) == 0 {
+		if kubeClient, err = getKubeClient(slog.Default()); err != nil {
+			return err
+		}
+	}
+	sealedSecretsPublicKey, err := getSealedSecretsPublicKey(context.Background(), slog.Default(), kubeClient)
+	if err != nil {
+		return err
+	}
+
+	sealedSecretManifest, err := sealSecret(secretManifest, sealedSecretsPublicKey)
+	if err != nil {
+		return fmt.Errorf("failed generating Sealed Secret from Kubernetes Secret : %w", err)
+	}
+
+	if *outputFile == "-" {
+		_, err = os.Stdout.Write(sealedSecretManifest)
+	} else {
+		err = os.WriteFile(*outputFile, sealedSecretManifest, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("failed writing Sealed Secret manifest : %w", err)
+	}
+	slog.Info("✅ Sealed the Kubernetes Secret", "cluster", config.ClusterName)
+	return nil
+}
+
+func runStatusCommand(args []string) error {
+	flagSet := flag.NewFlagSet("status", flag.ContinueOnError)
+	configFlags := addConfigFlags(flagSet)
+	addLogFlags(flagSet)
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+
+	if err := configFlags.loadSingleCluster(); err != nil {
+		return err
+	}
+
+	kubeClient, err := getKubeClient(slog.Default())
+	if err != nil {
+		return err
+	}
+	argocdApps, err := kubeClient.listArgocdApps(context.Background())
+	if err != nil {
+		return errorf(exitCodeCluster, "failed getting ArgoCD apps : %w", err)
+	}
+
+	type ArgocdAppStatus struct{ sync, health, message string }
+	argocdAppStatuses := map[string]ArgocdAppStatus{}
+	for _, argocdApp := range argocdApps {
+		status := ArgocdAppStatus{}
+		status.sync, _, _ = unstructured.NestedString(argocdApp.Object, "status", "sync", "status")
+		status.health, _, _ = unstructured.NestedString(argocdApp.Object, "status", "health", "status")
+		status.message, _, _ = unstructured.NestedString(argocdApp.Object, "status", "health", "message")
+		argocdAppStatuses[argocdApp.GetName()] = status
+	}
+
+	unhealthyArgocdApps := 0
+	tabWriter := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tabWriter, "NAME\tSYNC\tHEALTH\tMESSAGE")
+	for _, argocdApp := range getArgocdApps() {
+		status, ok := argocdAppStatuses[argocdApp.Name]
+		if !ok {
+			status = ArgocdAppStatus{sync: "-", health: "Missing"}
+		}
+		if status.sync != "Synced" || status.health != "Healthy" {
+			unhealthyArgocdApps++
+		}
+		fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%s\n", argocdApp.Name, status.sync, status.health, status.message)
+	}
+	tabWriter.Flush()
+
+	if unhealthyArgocdApps > 0 {
+		slog.Warn("⚠️ ArgoCD apps aren't synced and healthy", "cluster", config.ClusterName, "count", unhealthyArgocdApps)
+		return nil
+	}
+	slog.Info("✅ All ArgoCD apps are synced and healthy", "cluster", config.ClusterName)
+	return nil
+}
+
+func runUpgradeCommand(args []string) error {
+	flagSet := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	configFlags := addConfigFlags(flagSet)
+	flagSet.BoolVar(&resealSecrets, "reseal-secrets", false, "Reseal the existing Sealed Secrets (for e.g. after rotating credentials), instead of keeping them")
+	resume := flagSet.Bool("resume", false, "Resume the upgrade pipeline from the last finished stage")
+	stateFile := flagSet.String("state-file", "", "Path to the file where the upgrade pipeline's progress is recorded (defaults to ~/.kubeaid/state/<cluster-name>-upgrade.yaml)")
+	addPromptFlags(flagSet)
+	addLogFlags(flagSet)
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+
+	if err := configFlags.load(); err != nil {
+		return err
+	}
+
+	if err := ensurePrerequisitesInstalled(); err != nil {
+		return err
+	}
+
+	if err := runPipeline(upgradePipeline, *stateFile, *resume); err != nil {
+		return err
+	}
+
+	slog.Info("💫 Finished upgrading", "clusters", strings.Join(getClusterNames(), ","))
+	return nil
+}
+
+func runDestroyCommand(args []string) error {
+	flagSet := flag.NewFlagSet("destroy", flag.ContinueOnError)
+	configFlags := addConfigFlags(flagSet)
+	resume := flagSet.Bool("resume", false, "Resume the destroy pipeline from the last finished stage")
+	stateFile := flagSet.String("state-file", "", "Path to the file where the destroy pipeline's progress is recorded (defaults to ~/.kubeaid/state/<cluster-name>-destroy.yaml)")
+	addPromptFlags(flagSet)
+	addLogFlags(flagSet)
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+
+	if err := configFlags.loadSingleCluster(); err != nil {
+		return err
+	}
+
+	// Everything deployed by ArgoCD gets deleted. So make sure the user means it.
+	switch {
+	case assumeYes:
+		slog.Info("✅ Destroying the cluster, since --yes is specified", "cluster", config.ClusterName)
+
+	case !isInteractive():
+		return errorf(exitCodeConfig, "not destroying cluster %s, since prompts are disabled. Rerun with --yes to confirm", config.ClusterName)
+
+	default:
+		if err := confirmDestroy(); err != nil {
+			return err
+		}
+	}
+
+	if err := runPipeline(destroyPipeline, *stateFile, *resume); err != nil {
+		return err
+	}
+
+	slog.Info("💫 Finished destroying", "cluster", config.ClusterName)
+	return nil
+}
+
+// confirmDestroy makes the user type the cluster name, before destroying it.
+func confirmDestroy() error {
+	var confirmedClusterName string
+	err := huh.NewInput().
+		Title(fmt.Sprintf("This deletes everything deployed by ArgoCD in cluster %s. Type the cluster name to confirm", config.ClusterName)).
+		Value(&confirmedClusterName).
+		Validate(func(value string) error {
+			if value != config.ClusterName {
+				return errors.New("doesn't match the cluster name")
+			}
+			return nil
+		}).
+		Run()
+	if err != nil {
+		return fmt.Errorf("not destroying cluster %s : %w", config.ClusterName, err)
+	}
+	return nil
+}
+
+func runVersionCommand(args []string) error {
+	fmt.Println(getVersion())
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Prefixes of references, which secret-bearing config fields (tagged with secret:"true") can use
+// instead of plaintext values.
+const (
+	secretReferencePrefixFile = "file:"
+	secretReferencePrefixExec = "exec:"
+	secretReferencePrefixEnv  = "env:"
+)
+
+// resolveConfigSecrets resolves the secret-bearing fields of the parsed config. Their values can
+// reference environment variables (${NAME}), or be references like file:/path, exec:command or
+// env:NAME. The resolved values get redacted from the logs.
+func resolveConfigSecrets(config *Config, configNode *yaml.Node) []ConfigValidationError {
+	v := &configValidator{root: configNode}
+	v.resolveSecrets(reflect.ValueOf(config).Elem(), nil)
+	return v.errors
+}
+
+// Resolved secrets, keyed by their values in the config file. Secrets shared by the clusters listed
+// in the config file get resolved only once (so for e.g. a password manager doesn't prompt for each
+// cluster).
+var resolvedSecrets = map[string]string{}
+
+func (v *configValidator) resolveSecrets(value reflect.Value, path []any) {
+	for i := 0; i < value.NumField(); i++ {
+		field, fieldValue := value.Type().Field(i), value.Field(i)
+		fieldPath := append(slices.Clone(path), getYAMLFieldName(field))
+
+		switch {
+		case fieldValue.Kind() == reflect.Struct:
+			v.resolveSecrets(fieldValue, fieldPath)
+
+		case field.Tag.Get("secret") == "true" && fieldValue.Kind() == reflect.String && !fieldValue.IsZero():
+			resolvedValue, ok := resolvedSecrets[fieldValue.String()]
+			if !ok {
+				var err error
+				if resolvedValue, err = resolveSecret(fieldValue.String()); err != nil {
+					v.addError(err.Error(), fieldPath...)
+					continue
+				}
+				resolvedSecrets[fieldValue.String()] = resolvedValue
+			}
+			fieldValue.SetString(resolvedValue)
+			registerSecretForRedaction(resolvedValue)
+		}
+	}
+}
+
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretReferencePrefixFile):
+		filePath := strings.TrimPrefix(value, secretReferencePrefixFile)
+		fileContents, err := os.ReadFile(filePath)
+		if err != nil {
+			return "", fmt.Errorf("failed reading secret from file %s : %v", filePath, err)
+		}
+		return strings.TrimRight(string(fileContents), "\r\n"), nil
+
+	case strings.HasPrefix(value, secretReferencePrefixExec):
+		// The command isn't logged, since it may contain the secret as well.
+		command := strings.TrimPrefix(value, secretReferencePrefixExec)
+		stderr := &bytes.Buffer{}
+		cmd := parseCommand(command)
+		cmd.Stderr = stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("failed executing command to get secret : %v : %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimRight(string(output), "\r\n"), nil
+
+	case strings.HasPrefix(value, secretReferencePrefixEnv):
+		name := strings.TrimPrefix(value, secretReferencePrefixEnv)
+		envValue, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s isn't set", name)
+		}
+		return envValue, nil
+
+	default:
+		unsetEnvVars := []string{}
+		expandedValue := os.Expand(value, func(name string) string {
+			envValue, ok := os.LookupEnv(name)
+			if !ok {
+				unsetEnvVars = append(unsetEnvVars, name)
+			}
+			return envValue
+		})
+		if len(unsetEnvVars) > 0 {
+			return "", fmt.Errorf("environment variable(s) %s aren't set", strings.Join(unsetEnvVars, ", "))
+		}
+		return expandedValue, nil
+	}
+}
+
+// RedactingWriter replaces the registered secrets with a placeholder, before writing to the
+// underlying writer. The logger writes to it, so secrets never show up in the logs.
+type RedactingWriter struct {
+	out io.Writer
+
+	mutex   sync.RWMutex
+	secrets []string
+}
+
+var logRedactor = &RedactingWriter{out: os.Stderr}
+
+// Occurrences of secrets shorter than this are only redacted when they aren't part of a longer
+// word, since redacting every occurrence of a few characters would make the logs unreadable.
+const minSubstringRedactedSecretLength = 4
+
+func registerSecretForRedaction(secret string) {
+	if len(secret) == 0 {
+		return
+	}
+
+	logRedactor.mutex.Lock()
+	defer logRedactor.mutex.Unlock()
+
+	if !slices.Contains(logRedactor.secrets, secret) {
+		logRedactor.secrets = append(logRedactor.secrets, secret)
+		// Redact longer secrets first, in case a secret contains another one.
+		slices.SortFunc(logRedactor.secrets, func(a, b string) int {
+			return len(b) - len(a)
+		})
+	}
+}
+
+func (r *RedactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.out, r.redact(string(p))); err != nil {
+		return 0, err
+	}
+	// Callers expect the length of what they passed in.
+	return len(p), nil
+}
+
+func (r *RedactingWriter) redact(value string) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, secret := range r.secrets {
+		value = redactSecretOccurrences(value, secret)
+	}
+	return value
+}
+
+// redactSecretOccurrences replaces the occurrences of the secret in value with a placeholder. If
+// the secret is short, occurrences inside longer words are left as they are.
+func redactSecretOccurrences(value, secret string) string {
+	if len(secret) >= minSubstringRedactedSecretLength {
+		return strings.ReplaceAll(value, secret, redactedPlaceholder)
+	}
+
+	redactedValue := &strings.Builder{}
+	i := 0
+	for {
+		j := strings.Index(value[i:], secret)
+		if j == -1 {
+			break
+		}
+		start, end := i+j, i+j+len(secret)
+
+		previousRune, _ := utf8.DecodeLastRuneInString(value[:start])
+		nextRune, _ := utf8.DecodeRuneInString(value[end:])
+		if isWordRune(previousRune) || isWordRune(nextRune) {
+			redactedValue.WriteString(value[i : start+1])
+			i = start + 1
+			continue
+		}
+
+		redactedValue.WriteString(value[i:start])
+		redactedValue.WriteString(redactedPlaceholder)
+		i = end
+	}
+	redactedValue.WriteString(value[i:])
+	return redactedValue.String()
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// ConfigValidationError points to an invalid field in the config file.
+type ConfigValidationError struct {
+	Line    int
+	Field   string
+	Message string
+
+	// Cluster the error was found in, when the config file lists multiple clusters.
+	Cluster string
+}
+
+func (e ConfigValidationError) Error() string {
+	message := fmt.Sprintf("%s : %s", e.Field, e.Message)
+	if e.Line > 0 {
+		message = fmt.Sprintf("line %d : %s", e.Line, message)
+	}
+	if len(e.Cluster) > 0 {
+		message = fmt.Sprintf("%s (in cluster %s)", message, e.Cluster)
+	}
+	return message
+}
+
+// ConfigFile is the layout of the config file. Its top-level fields configure a single cluster.
+// When clusters are listed, the top-level fields are the defaults shared by them, which each
+// cluster can override.
+type ConfigFile struct {
+	Config `yaml:",inline"`
+
+	Clusters []Config `yaml:"clusters,omitempty"`
+}
+
+// Config fields which can't be overridden per cluster, since all the clusters listed in the config
+// file get their files in a single PR to the kubeaid-config repo.
+var sharedConfigFields = []string{"git", "kubeaidConfigRepoURL", "forge"}
+
+func parseConfigFile(configFile *string) error {
+	configFileContents, err := os.ReadFile(*configFile)
+	if err != nil {
+		return errorf(exitCodeConfig, "failed reading config file : %w", err)
+	}
+
+	// Reject unknown fields, so typos don't get silently ignored.
+	parsedConfigFile := ConfigFile{}
+	decoder := yaml.NewDecoder(bytes.NewReader(configFileContents))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&parsedConfigFile); err != nil {
+		return errorf(exitCodeConfig, "failed unmarshalling config file : %w", err)
+	}
+
+	// Used to find out the line numbers of invalid fields.
+	configFileNode := &yaml.Node{}
+	if err = yaml.Unmarshal(configFileContents, configFileNode); err != nil {
+		return errorf(exitCodeConfig, "failed unmarshalling config file : %w", err)
+	}
+
+	validationErrors := []ConfigValidationError{}
+	clusterConfigNodes := []*yaml.Node{configFileNode}
+	clusterConfigs = []Config{parsedConfigFile.Config}
+	if len(parsedConfigFile.Clusters) > 0 {
+		clusterConfigNodes, validationErrors = getClusterConfigNodes(configFileNode)
+
+		clusterConfigs = make([]Config, len(clusterConfigNodes))
+		for i, clusterConfigNode := range clusterConfigNodes {
+			if err = clusterConfigNode.Decode(&clusterConfigs[i]); err != nil {
+				return errorf(exitCodeConfig, "failed unmarshalling config of cluster %d : %w", i, err)
+			}
+		}
+	}
+
+	for i := range clusterConfigs {
+		// Secrets need to be resolved before validation.
+		clusterValidationErrors := resolveConfigSecrets(&clusterConfigs[i], clusterConfigNodes[i])
+		clusterValidationErrors = append(clusterValidationErrors, validateConfig(&clusterConfigs[i], clusterConfigNodes[i])...)
+
+		if len(parsedConfigFile.Clusters) > 0 {
+			for j := range clusterValidationErrors {
+				clusterValidationErrors[j].Cluster = clusterConfigs[i].ClusterName
+			}
+		}
+		validationErrors = append(validationErrors, clusterValidationErrors...)
+	}
+	validationErrors = dedupeConfigValidationErrors(validationErrors)
+
+	slices.SortStableFunc(validationErrors, func(a, b ConfigValidationError) int {
+		return a.Line - b.Line
+	})
+	if len(validationErrors) > 0 {
+		for _, validationError := range validationErrors {
+			slog.Error("❌ " + validationError.Error())
+		}
+		return errorf(exitCodeConfig, "%w : found %d error(s) in config file %s", ErrInvalidConfig, len(validationErrors), *configFile)
+	}
+
+	config = clusterConfigs[0]
+	slog.Info("✅ Parsed the config file", "clusters", strings.Join(getClusterNames(), ","))
+	return nil
+}
+
+// getClusterConfigNodes returns the configs of the clusters listed in the config file, with the
+// top-level fields (the shared defaults) merged into each of them.
+func getClusterConfigNodes(configFileNode *yaml.Node) ([]*yaml.Node, []ConfigValidationError) {
+	v := &configValidator{root: configFileNode}
+
+	root := getYAMLDocumentRoot(configFileNode)
+	defaults := *root
+	defaults.Content = nil
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "clusters" {
+			defaults.Content = append(defaults.Content, root.Content[i], root.Content[i+1])
+		}
+	}
+
+	clusterConfigNodes := []*yaml.Node{}
+	clusterNames := []string{}
+	for i, clusterNode := range getYAMLMappingValue(root, "clusters").Content {
+		for _, sharedConfigField := range sharedConfigFields {
+			if getYAMLMappingValue(clusterNode, sharedConfigField) != nil {
+				v.addError("can't be overridden per cluster, since all the clusters are bootstrapped in a single PR", "clusters", i, sharedConfigField)
+			}
+		}
+
+		clusterConfigNode := mergeConfigNodes(&defaults, clusterNode)
+		// Errors about missing fields point to the cluster.
+		clusterConfigNode.Line = clusterNode.Line
+		clusterConfigNodes = append(clusterConfigNodes, clusterConfigNode)
+
+		if clusterNameNode := getYAMLMappingValue(clusterConfigNode, "clusterName"); clusterNameNode != nil {
+			if slices.Contains(clusterNames, clusterNameNode.Value) {
+				v.addError(fmt.Sprintf("duplicate cluster %s", clusterNameNode.Value), "clusters", i, "clusterName")
+			}
+			clusterNames = append(clusterNames, clusterNameNode.Value)
+		}
+	}
+	return clusterConfigNodes, v.errors
+}
+
+// mergeConfigNodes returns the defaults, with the fields specified in overrides replacing them.
+// Mappings are merged recursively, while sequences and scalars get replaced entirely.
+func mergeConfigNodes(defaults, overrides *yaml.Node) *yaml.Node {
+	if !isYAMLMapping(defaults) || !isYAMLMapping(overrides) {
+		return overrides
+	}
+
+	merged := *defaults
+	merged.Content = nil
+	for i := 0; i+1 < len(defaults.Content); i += 2 {
+		value := defaults.Content[i+1]
+		if override := getYAMLMappingValue(overrides, defaults.Content[i].Value); override != nil {
+			value = mergeConfigNodes(value, override)
+		}
+		merged.Content = append(merged.Content, defaults.Content[i], value)
+	}
+	for i := 0; i+1 < len(overrides.Content); i += 2 {
+		if getYAMLMappingValue(defaults, overrides.Content[i].Value) == nil {
+			merged.Content = append(merged.Content, overrides.Content[i], overrides.Content[i+1])
+		}
+	}
+	return &merged
+}
+
+// dedupeConfigValidationErrors removes the duplicates of errors found in the shared defaults, which
+// show up once per cluster. The remaining error isn't attributed to any cluster.
+func dedupeConfigValidationErrors(validationErrors []ConfigValidationError) []ConfigValidationError {
+	type ErrorKey struct {
+		line           int
+		field, message string
+	}
+	errorIndices := map[ErrorKey]int{}
+
+	dedupedErrors := []ConfigValidationError{}
+	for _, validationError := range validationErrors {
+		errorKey := ErrorKey{validationError.Line, validationError.Field, validationError.Message}
+		if i, ok := errorIndices[errorKey]; ok {
+			if dedupedErrors[i].Cluster != validationError.Cluster {
+				dedupedErrors[i].Cluster = ""
+			}
+			continue
+		}
+		errorIndices[errorKey] = len(dedupedErrors)
+		dedupedErrors = append(dedupedErrors, validationError)
+	}
+	return dedupedErrors
+}
+
+// getClusterNames returns the names of the clusters, the command runs for.
+func getClusterNames() []string {
+	clusterNames := []string{}
+	for _, clusterConfig := range clusterConfigs {
+		clusterNames = append(clusterNames, clusterConfig.ClusterName)
+	}
+	return clusterNames
+}
+
+type configValidator struct {
+	// Root node of the config file, used to find out line numbers.
+	root *yaml.Node
+
+	errors []ConfigValidationError
+}
+
+// validateConfig validates the parsed config, returning all the errors found. configNode is the
+// config's YAML node, used to find out line numbers.
+func validateConfig(config *Config, configNode *yaml.Node) []ConfigValidationError {
+	v := &configValidator{root: configNode}
+
+	// Validate required fields and enums, as specified by the struct tags.
+	v.validateStruct(reflect.ValueOf(*config), nil)
+
+	v.validateGitURL(config.KubeaidRepoURL, "kubeaidRepoURL")
+	v.validateGitURL(config.KubeaidConfigRepoURL, "kubeaidConfigRepoURL")
+
+	if len(config.GrafanaURL) > 0 {
+		if err := validateHTTPURL(config.GrafanaURL); err != nil {
+			v.addError(err.Error(), "grafanaURL")
+		}
+	}
+
+	if len(config.ClusterName) > 0 {
+		if err := validateDNS1123Label(config.ClusterName); err != nil {
+			v.addError(err.Error(), "clusterName")
+		}
+	}
+
+	// Password is used as the passphrase, when an SSH private key is specified.
+	gitAuthMethods := 0
+	if len(config.Git.SSHPrivateKey) > 0 || len(config.Git.Password) > 0 {
+		gitAuthMethods++
+	}
+	if config.Git.UseSSHAgentAuth {
+		gitAuthMethods++
+	}
+	if gitAuthMethods != 1 {
+		v.addError("exactly one of password, sshPrivateKey or useSSHAgentAuth must be specified", "git")
+	}
+
+	if len(config.Forge.Type) > 0 && len(config.Forge.Token) == 0 {
+		v.addError("is required when forge type is specified", "forge", "token")
+	}
+
+	argocdAppNames := []string{}
+	for i, argocdApp := range config.ArgocdApps {
+		if len(argocdApp.Name) == 0 {
+			continue
+		}
+		if err := validateDNS1123Label(argocdApp.Name); err != nil {
+			v.addError(err.Error(), "argocdApps", i, "name")
+		}
+		if slices.Contains(argocdAppNames, argocdApp.Name) {
+			v.addError(fmt.Sprintf("duplicate ArgoCD app %s", argocdApp.Name), "argocdApps", i, "name")
+		}
+		argocdAppNames = append(argocdAppNames, argocdApp.Name)
+	}
+
+	if config.ConnectObmondo {
+		if len(config.Obmondo.ClientCertFile) == 0 {
+			v.addError("is required when connectObmondo is true", "obmondo", "clientCertFile")
+		}
+		if len(config.Obmondo.ClientKeyFile) == 0 {
+			v.addError("is required when connectObmondo is true", "obmondo", "clientKeyFile")
+		}
+	}
+
+	slices.SortStableFunc(v.errors, func(a, b ConfigValidationError) int {
+		return a.Line - b.Line
+	})
+	return v.errors
+}
+
+// addError records a validation error for the field at the given path. A path is made up of
+// mapping keys (string) and sequence indices (int).
+func (v *configValidator) addError(message string, path ...any) {
+	field := ""
+	for _, pathElement := range path {
+		switch pathElement := pathElement.(type) {
+		case int:
+			field += fmt.Sprintf("[%d]", pathElement)
+		default:
+			if len(field) > 0 {
+				field += "."
+			}
+			field += fmt.Sprint(pathElement)
+		}
+	}
+
+	v.errors = append(v.errors, ConfigValidationError{
+		Line:    getNodeLine(v.root, path),
+		Field:   field,
+		Message: message,
+	})
+}
+
+// getNodeLine returns the line number of the node at the given path. If the node doesn't exist,
+// the line number of its deepest existing ancestor is returned.
+func getNodeLine(node *yaml.Node, path []any) int {
+	if node == nil {
+		return 0
+	}
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	line := node.Line
+	for _, pathElement := range path {
+		var child *yaml.Node
+
+		switch pathElement := pathElement.(type) {
+		case int:
+			if node.Kind == yaml.SequenceNode && pathElement < len(node.Content) {
+				child = node.Content[pathElement]
+			}
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == pathElement {
+						child = node.Content[i+1]
+						break
+					}
+				}
+			}
+		}
+
+		if child == nil {
+			break
+		}
+		node, line = child, child.Line
+	}
+	return line
+}
+
+// validateStruct validates the required and enum struct tags, recursively.
+func (v *configValidator) validateStruct(value reflect.Value, path []any) {
+	for i := 0; i < value.NumField(); i++ {
+		field, fieldValue := value.Type().Field(i), value.Field(i)
+		fieldPath := append(slices.Clone(path), getYAMLFieldName(field))
+
+		if field.Tag.Get("validate") == "required" && fieldValue.IsZero() {
+			v.addError("is required", fieldPath...)
+			continue
+		}
+
+		if enum := field.Tag.Get("enum"); len(enum) > 0 && !fieldValue.IsZero() {
+			if !slices.Contains(strings.Split(enum, ","), fieldValue.String()) {
+				v.addError(fmt.Sprintf("must be one of %s", strings.ReplaceAll(enum, ",", ", ")), fieldPath...)
+			}
+		}
+
+		switch fieldValue.Kind() {
+		case reflect.Struct:
+			v.validateStruct(fieldValue, fieldPath)
+
+		case reflect.Slice:
+			if field.Type.Elem().Kind() != reflect.Struct {
+				continue
+			}
+			for j := 0; j < fieldValue.Len(); j++ {
+				v.validateStruct(fieldValue.Index(j), append(slices.Clone(fieldPath), j))
+			}
+		}
+	}
+}
+
+// Matches SCP-like git URLs, like git@github.com:obmondo/kubeaid-config.git.
+var scpLikeGitURLRegex = regexp.MustCompile(`^([\w.-]+@)?[\w.-]+:[^/].*$`)
+
+func (v *configValidator) validateGitURL(gitURL, fieldName string) {
+	if len(gitURL) == 0 {
+		return
+	}
+	if err := validateGitURL(gitURL); err != nil {
+		v.addError(err.Error(), fieldName)
+	}
+}
+
+func validateGitURL(gitURL string) error {
+	if !strings.Contains(gitURL, "://") {
+		if !scpLikeGitURLRegex.MatchString(gitURL) {
+			return fmt.Errorf("must be a valid git URL")
+		}
+		return nil
+	}
+
+	parsedURL, err := url.Parse(gitURL)
+	if err != nil {
+		return fmt.Errorf("must be a valid git URL : %v", err)
+	}
+	if !slices.Contains([]string{"http", "https", "ssh", "git", "file"}, parsedURL.Scheme) {
+		return fmt.Errorf("must be a valid git URL, with scheme http, https, ssh, git or file")
+	}
+	if parsedURL.Scheme != "file" && len(parsedURL.Host) == 0 {
+		return fmt.Errorf("must be a valid git URL, containing a host")
+	}
+	return nil
+}
+
+func validateHTTPURL(httpURL string) error {
+	parsedURL, err := url.Parse(httpURL)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || len(parsedURL.Host) == 0 {
+		return fmt.Errorf("must be a valid HTTP(S) URL")
+	}
+	return nil
+}
+
+// validateDNS1123Label returns an error if the value isn't a valid DNS-1123 label (as required for
+// cluster and ArgoCD app names).
+func validateDNS1123Label(value string) error {
+	if messages := validation.IsDNS1123Label(value); len(messages) > 0 {
+		return errors.New(strings.Join(messages, ", "))
+	}
+	return nil
+}
+
+func getYAMLFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if len(name) == 0 {
+		return field.Name
+	}
+	return name
+}
+
+// printConfigJSONSchema prints the JSON Schema of the config file, which can be used for editor
+// integration.
+func printConfigJSONSchema() error {
+	schema := getJSONSchema(reflect.TypeOf(Config{}))
+
+	// Clusters can override the top-level fields, except the shared ones. So when clusters are
+	// listed, the required fields can be specified in either place.
+	clusterSchema := getJSONSchema(reflect.TypeOf(Config{}))
+	removeJSONSchemaRequired(clusterSchema)
+	for _, sharedConfigField := range sharedConfigFields {
+		delete(clusterSchema["properties"].(map[string]any), sharedConfigField)
+	}
+	schema["properties"].(map[string]any)["clusters"] = map[string]any{
+		"type":  "array",
+		"items": clusterSchema,
+	}
+	schema["if"] = map[string]any{"required": []string{"clusters"}}
+	schema["else"] = map[string]any{"required": schema["required"]}
+	delete(schema, "required")
+
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "KubeAid cluster bootstrap script config"
+
+	schemaJSON, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed marshalling config JSON Schema : %w", err)
+	}
+	fmt.Println(string(schemaJSON))
+	return nil
+}
+
+// removeJSONSchemaRequired removes the required fields from the given JSON Schema and its nested
+// objects. Objects in arrays are left as they are, since arrays get replaced instead of merged.
+func removeJSONSchemaRequired(schema map[string]any) {
+	delete(schema, "required")
+	if properties, ok := schema["properties"].(map[string]any); ok {
+		for _, propertySchema := range properties {
+			removeJSONSchemaRequired(propertySchema.(map[string]any))
+		}
+	}
+}
+
+// getJSONSchema returns the JSON Schema for the given type, based on its yaml, validate and enum
+// struct tags.
+func getJSONSchema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := map[string]any{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			fieldName := getYAMLFieldName(field)
+
+			fieldSchema := getJSONSchema(field.Type)
+			if enum := field.Tag.Get("enum"); len(enum) > 0 {
+				fieldSchema["enum"] = strings.Split(enum, ",")
+			}
+			properties[fieldName] = fieldSchema
+
+			if field.Tag.Get("validate") == "required" {
+				required = append(required, fieldName)
+			}
+		}
+
+		schema := map[string]any{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+
+	case reflect.Slice:
+		return map[string]any{
+			"type":  "array",
+			"items": getJSONSchema(t.Elem()),
+		}
+
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+
+	default:
+		return map[string]any{"type": "string"}
+	}
+}
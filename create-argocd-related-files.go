@@ -1,20 +1,37 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"html/template"
-	"log"
+	"io/fs"
+	"log/slog"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 
 	"github.com/go-git/go-git/v5/plumbing/transport"
 )
 
 type (
+	// ArgocdApp is an ArgoCD app which gets deployed to the cluster. Helm chart based apps point to a
+	// Helm chart in the KubeAid repo.
+	ArgocdApp struct {
+		Name           string   `yaml:"name" validate:"required"`
+		Namespace      string   `yaml:"namespace,omitempty"`
+		ChartPath      string   `yaml:"chartPath,omitempty"`
+		TargetRevision string   `yaml:"targetRevision,omitempty"`
+		SyncOptions    []string `yaml:"syncOptions,omitempty"`
+	}
+
 	ArgocdAppTemplateValues struct {
+		ArgocdApp
+
 		ClusterName,
 		KubeAidRepo,
-		KubeAidConfigRepo,
+		KubeAidConfigRepo string
+
+		// Default branch of the kubeaid-config repo, which the ArgoCD apps track.
 		Branch string
 	}
 
@@ -25,104 +42,332 @@ type (
 	}
 )
 
-var defaultArgocdApps = []string{
-	"root",
-	"argo-cd",
-	"cilium",
-	"cluster-api",
-	"kube-prometheus",
-	"sealed-secrets",
-	"traefik",
+var (
+	// Default settings of ArgoCD apps, which have dedicated templates. They can be overridden from
+	// the config file.
+	argocdAppsCatalogue = map[string]ArgocdApp{
+		"root": {
+			Namespace:   "argocd",
+			SyncOptions: []string{"ApplyOutOfSyncOnly=true"},
+		},
+		"argo-cd": {
+			Namespace: "argocd",
+		},
+		"cert-manager": {
+			Namespace:   "cert-manager",
+			SyncOptions: []string{"CreateNamespace=true", "ApplyOutOfSyncOnly=true"},
+		},
+		"cilium": {
+			Namespace: "cilium",
+		},
+		"cluster-api": {
+			Namespace:   "cluster-api",
+			SyncOptions: []string{"CreateNamespace=true", "ApplyOutOfSyncOnly=true"},
+		},
+		"kube-prometheus": {
+			Namespace: "monitoring",
+		},
+		"obmondo-k8s-agent": {
+			Namespace: "obmondo",
+		},
+		"sealed-secrets": {
+			Namespace: "system",
+		},
+		"traefik": {
+			Namespace:   "traefik",
+			SyncOptions: []string{"CreateNamespace=true"},
+		},
+	}
+
+	// ArgoCD apps deployed, when none are specified in the config file.
+	defaultArgocdApps = []string{
+		"root",
+		"argo-cd",
+		"cilium",
+		"cluster-api",
+		"kube-prometheus",
+		"sealed-secrets",
+		"traefik",
+	}
+
+	// ArgoCD apps rendered from their dir in the kubeaid-config repo, instead of a Helm chart in the
+	// KubeAid repo. So they don't have a chart path or a KubeAid revision.
+	configRepoArgocdApps = []string{"root", "kube-prometheus"}
+
+	defaultArgocdAppSyncOptions = []string{"ApplyOutOfSyncOnly=true", "CreateNamespace=true"}
+)
+
+// getArgocdApps returns the ArgoCD apps to be deployed, with the overrides from the config file
+// applied on top of the defaults. The root app is always deployed, and the obmondo-k8s-agent app
+// when connecting to Obmondo.
+func getArgocdApps() []ArgocdApp {
+	configuredArgocdApps := config.ArgocdApps
+	if len(configuredArgocdApps) == 0 {
+		for _, argocdAppName := range defaultArgocdApps {
+			configuredArgocdApps = append(configuredArgocdApps, ArgocdApp{Name: argocdAppName})
+		}
+	}
+
+	argocdApps := []ArgocdApp{getArgocdApp(ArgocdApp{Name: "root"})}
+	for _, configuredArgocdApp := range configuredArgocdApps {
+		if configuredArgocdApp.Name == "root" {
+			argocdApps[0] = getArgocdApp(configuredArgocdApp)
+			continue
+		}
+		argocdApps = append(argocdApps, getArgocdApp(configuredArgocdApp))
+	}
+
+	if config.ConnectObmondo && !slices.ContainsFunc(argocdApps, func(argocdApp ArgocdApp) bool {
+		return argocdApp.Name == "obmondo-k8s-agent"
+	}) {
+		argocdApps = append(argocdApps, getArgocdApp(ArgocdApp{Name: "obmondo-k8s-agent"}))
+	}
+	return argocdApps
 }
 
-func createArgoCDRelatedFiles(clusterDir string, defaultBranchName string, gitAuthMethod transport.AuthMethod) {
+// getArgocdApp applies the non-empty fields of the given ArgoCD app config, on top of its defaults.
+// Apps missing from the catalogue default to the Helm chart with the same name, in the
+// argocd-helm-charts directory of the KubeAid repo.
+func getArgocdApp(overrides ArgocdApp) ArgocdApp {
+	argocdApp := argocdAppsCatalogue[overrides.Name]
+	argocdApp.Name = overrides.Name
+
+	if len(overrides.Namespace) > 0 {
+		argocdApp.Namespace = overrides.Namespace
+	}
+	if len(overrides.ChartPath) > 0 {
+		argocdApp.ChartPath = overrides.ChartPath
+	}
+	if len(overrides.TargetRevision) > 0 {
+		argocdApp.TargetRevision = overrides.TargetRevision
+	}
+	if len(overrides.SyncOptions) > 0 {
+		argocdApp.SyncOptions = overrides.SyncOptions
+	}
+
+	if len(argocdApp.Namespace) == 0 {
+		argocdApp.Namespace = argocdApp.Name
+	}
+	if !slices.Contains(configRepoArgocdApps, argocdApp.Name) {
+		if len(argocdApp.ChartPath) == 0 {
+			argocdApp.ChartPath = fmt.Sprintf("argocd-helm-charts/%s", argocdApp.Name)
+		}
+		if len(argocdApp.TargetRevision) == 0 {
+			argocdApp.TargetRevision = kubeaidRevision
+		}
+	}
+	if argocdApp.SyncOptions == nil {
+		argocdApp.SyncOptions = defaultArgocdAppSyncOptions
+	}
+	return argocdApp
+}
+
+func createArgoCDRelatedFiles(logger *slog.Logger, clusterDir string, defaultBranchName string, gitAuthMethod transport.AuthMethod) error {
 	argocdAppsDir := fmt.Sprintf("%s/argocd-apps/templates", clusterDir)
 	if err := os.MkdirAll(argocdAppsDir, os.ModePerm); err != nil {
-		log.Fatalf("❌ Failed creating dir %s in cluster-dir : %v", argocdAppsDir, err)
+		return fmt.Errorf("failed creating dir %s in cluster-dir : %w", argocdAppsDir, err)
+	}
+
+	templatesPath := "argocd-apps/templates/*"
+	templates, err := parseTemplates(templatesPath)
+	if err != nil {
+		return fmt.Errorf("failed parsing templates at %s : %w", templatesPath, err)
 	}
 
-	templatesPath := "k8s/cluster/argocd-apps/templates/*"
-	templates, err := template.ParseGlob(templatesPath)
+	// ArgoCD apps without a dedicated template, use the generic one.
+	genericTemplatePath := "argocd-app.yaml"
+	genericTemplate, err := parseTemplates(genericTemplatePath)
 	if err != nil {
-		log.Fatalf("❌ Failed parsing templates at %s : %v", templatesPath, err)
+		return fmt.Errorf("failed parsing template at %s : %w", genericTemplatePath, err)
 	}
 
-	for _, argocdAppName := range defaultArgocdApps {
+	// Conflicts between the user's edits and the template changes, in the values files.
+	valuesFilesConflicts := []YAMLMergeConflict{}
+
+	for _, argocdApp := range getArgocdApps() {
+		argocdAppName := argocdApp.Name
+
 		argocdAppFilePath := fmt.Sprintf("%s/%v.yaml", argocdAppsDir, argocdAppName)
 		argocdAppFile, err := os.Create(argocdAppFilePath)
 		if err != nil {
-			log.Fatalf("❌ Failed creating ArgoCD app file at %s : %v", argocdAppFilePath, err)
+			return fmt.Errorf("failed creating ArgoCD app file at %s : %w", argocdAppFilePath, err)
 		}
 		argocdAppTemplateName := fmt.Sprintf("%s.yaml", argocdAppName)
-		err = templates.ExecuteTemplate(argocdAppFile, argocdAppTemplateName, ArgocdAppTemplateValues{
+		argocdAppTemplate := templates.Lookup(argocdAppTemplateName)
+		if argocdAppTemplate == nil {
+			argocdAppTemplate = genericTemplate
+		}
+		err = argocdAppTemplate.Execute(argocdAppFile, ArgocdAppTemplateValues{
+			ArgocdApp:         argocdApp,
 			ClusterName:       config.ClusterName,
 			KubeAidRepo:       config.KubeaidRepoURL,
 			KubeAidConfigRepo: config.KubeaidConfigRepoURL,
 			Branch:            defaultBranchName,
 		})
 		if err != nil {
-			log.Fatalf("❌ Failed applying argocd-app template %s to file %s", argocdAppTemplateName, argocdAppFilePath)
+			return fmt.Errorf("failed applying argocd-app template %s to file %s : %w", argocdAppTemplateName, argocdAppFilePath, err)
 		}
 
 		switch argocdAppName {
 		case "root":
-			log.Println("✅ Generated file for 'root' ArgoCD app")
+			logger.Info("✅ Generated file for ArgoCD app", "app", "root")
 			continue
 
 		case "kube-prometheus":
 			kubePrometheusDir := fmt.Sprintf("%s/kube-prometheus", clusterDir)
 			if err := os.MkdirAll(kubePrometheusDir, os.ModePerm); err != nil {
-				log.Fatalf("❌ Failed creating %s in kubeaid-config repo : %v", kubePrometheusDir, err)
+				return fmt.Errorf("failed creating %s in kubeaid-config repo : %w", kubePrometheusDir, err)
 			}
 
 			// Create the jsonnet file.
 			jsonnetFileName := fmt.Sprintf("%s/%s-vars.jsonnet", clusterDir, config.ClusterName)
 			jsonnetFile, err := os.Create(jsonnetFileName)
 			if err != nil {
-				log.Fatalf("❌ Failed creating jsonnet file %s : %v", jsonnetFileName, err)
+				return fmt.Errorf("failed creating jsonnet file %s : %w", jsonnetFileName, err)
 			}
-			jsonnetTemplate, err := template.ParseFiles("k8s/cluster/cluster.jsonnet")
+			jsonnetTemplate, err := parseTemplates("cluster.jsonnet")
 			if err != nil {
-				log.Fatal("Failed parsing jsonnet template")
+				return fmt.Errorf("failed parsing jsonnet template : %w", err)
 			}
 			if err = jsonnetTemplate.Execute(jsonnetFile, JsonnetFileTemplateValues{
 				KubePrometheusVersion: config.KubePrometheusVersion,
 				GrafanaURL:            config.GrafanaURL,
 				ConnectObmondo:        config.ConnectObmondo,
 			}); err != nil {
-				log.Fatalf("❌ Failed executing jsonnet template against the jsonnet file : %v", err)
+				return fmt.Errorf("failed executing jsonnet template against the jsonnet file : %w", err)
 			}
 
-			// Clone kubeaid repo.
-			kubeaidRepoDir := tempDirPath + "/kubeaid"
-			gitCloneRepo(config.KubeaidRepoURL, kubeaidRepoDir, gitAuthMethod)
+			// The build script needs the KubeAid repo to be cloned. So we skip it in dry-run mode.
+			if dryRun {
+				logger.Info("⏭️ Skipping kube-prometheus build script in dry-run mode")
+				continue
+			}
+
+			// Files generated by a previous build (when upgrading the cluster) may not be generated
+			// anymore.
+			if err := os.RemoveAll(kubePrometheusDir); err != nil {
+				return fmt.Errorf("failed removing previously generated files in %s : %w", kubePrometheusDir, err)
+			}
+
+			// Clone kubeaid repo. Clusters using the same KubeAid repo and revision, share the clone.
+			kubeaidRepoDir := getKubeaidRepoDir()
+			if _, err := os.Stat(kubeaidRepoDir); os.IsNotExist(err) {
+				kubeaidRepo, err := gitCloneRepo(logger, config.KubeaidRepoURL, kubeaidRepoDir, gitAuthMethod)
+				if err != nil {
+					return err
+				}
+				if err = checkoutKubeaidRevision(logger, kubeaidRepo); err != nil {
+					return err
+				}
+			}
 
 			// Run the kube-prometheus build script.
-			log.Printf("Running kube-prometheus build script....")
 			kubePrometheusBuildScriptPath := fmt.Sprintf("%s/build/kube-prometheus/build.sh", kubeaidRepoDir)
 			kubePrometheusBuildCmd := exec.Command(kubePrometheusBuildScriptPath, clusterDir)
-			log.Printf("Executing command : %s", kubePrometheusBuildCmd)
+			logger.Info("👀 Running kube-prometheus build script", "command", kubePrometheusBuildCmd.String())
 			output, err := kubePrometheusBuildCmd.CombinedOutput()
-			log.Println(string(output))
+			logger.Debug("Output of kube-prometheus build script", "output", string(output))
 			if err != nil {
-				log.Fatalf("❌ Failed executing kube-prometheus build script : %v", err)
+				return fmt.Errorf("failed executing kube-prometheus build script : %w", err)
 			}
 
-			log.Println("✅ Generated files for 'kube-prometheus' ArgoCD app and ran kube-prometheus build script")
+			logger.Info("✅ Generated files for ArgoCD app and ran kube-prometheus build script", "app", "kube-prometheus")
 
 		default:
-			argocdAppValuesTemplateFilePath := fmt.Sprintf("k8s/cluster/argocd-apps/values-%s.yaml", argocdAppName)
-			argocdAppValuesFilePath := fmt.Sprintf("%s/argocd-apps/values-%s.yaml", clusterDir, argocdAppName)
-			if err = copyFile(argocdAppValuesTemplateFilePath, argocdAppValuesFilePath); err != nil {
-				log.Fatalf("❌ Failed copying argocd-app values file from %s to %s : %v", argocdAppValuesTemplateFilePath, argocdAppValuesFilePath, err)
+			valuesFileConflicts, err := generateArgocdAppValuesFile(logger, clusterDir, argocdAppName)
+			if err != nil {
+				return err
 			}
-			log.Printf("✅ Generated files for %s ArgoCD app", argocdAppName)
+			if len(valuesFileConflicts) > 0 {
+				valuesFilesConflicts = append(valuesFilesConflicts, valuesFileConflicts...)
+				continue
+			}
+			logger.Info("✅ Generated files for ArgoCD app", "app", argocdAppName)
+		}
+	}
+
+	// Never clobber the user's edits.
+	if len(valuesFilesConflicts) > 0 {
+		for _, conflict := range valuesFilesConflicts {
+			logger.Error(fmt.Sprintf("❌ Conflict in %v", conflict))
 		}
+		return fmt.Errorf("found %d %w. Make the values files match the new templates, or override the templates using --templates-dir, and rerun", len(valuesFilesConflicts), ErrValuesFilesConflicts)
 	}
 
-	argocdAppsChartTemplateFilePath := "k8s/cluster/argocd-apps/Chart.yaml"
+	argocdAppsChartTemplateFilePath := "argocd-apps/Chart.yaml"
 	argocdAppsChartFilePath := fmt.Sprintf("%s/argocd-apps/Chart.yaml", clusterDir)
-	if err = copyFile(argocdAppsChartTemplateFilePath, argocdAppsChartFilePath); err != nil {
-		log.Fatalf("❌ Failed copying argocd-apps Chart.yaml file from %s to %s : %v", argocdAppsChartTemplateFilePath, argocdAppsChartFilePath, err)
+	if err = copyFile(templatesFS, argocdAppsChartTemplateFilePath, argocdAppsChartFilePath); err != nil {
+		return fmt.Errorf("failed copying argocd-apps Chart.yaml file from %s to %s : %w", argocdAppsChartTemplateFilePath, argocdAppsChartFilePath, err)
+	}
+	return nil
+}
+
+// Dir (inside the cluster dir) where metadata about the generated files is recorded.
+const kubeaidMetadataDir = ".kubeaid"
+
+// generateArgocdAppValuesFile generates the values file of the given ArgoCD app, from its template.
+// Apps without a values file template, start with an empty values file.
+//
+// The generated content is recorded in the cluster's metadata dir. When the values file already
+// exists (when upgrading the cluster), it has usually been edited by the user since. So instead of
+// overwriting it, the recorded content, the edited file and the newly generated content get
+// three-way merged. Conflicts are returned, leaving the values file untouched.
+func generateArgocdAppValuesFile(logger *slog.Logger, clusterDir, argocdAppName string) ([]YAMLMergeConflict, error) {
+	valuesFileRelativePath := fmt.Sprintf("argocd-apps/values-%s.yaml", argocdAppName)
+	valuesFilePath := fmt.Sprintf("%s/%s", clusterDir, valuesFileRelativePath)
+	generatedValuesFilePath := fmt.Sprintf("%s/%s/generated/%s", clusterDir, kubeaidMetadataDir, valuesFileRelativePath)
+
+	generatedValues, err := fs.ReadFile(templatesFS, valuesFileRelativePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed reading argocd-app values file template %s : %w", valuesFileRelativePath, err)
+	}
+
+	values := generatedValues
+	currentValues, err := os.ReadFile(valuesFilePath)
+	switch {
+	case err == nil:
+		baseValues, err := os.ReadFile(generatedValuesFilePath)
+		if errors.Is(err, fs.ErrNotExist) {
+			// The cluster was bootstrapped before the generated content got recorded. So the user's
+			// edits can't be told apart from the template changes, and the values file is preserved.
+			logger.Warn("⚠️ Originally generated content of values file is unknown, so it's preserved as it is", "file", valuesFilePath)
+			baseValues = generatedValues
+		} else if err != nil {
+			return nil, fmt.Errorf("failed reading originally generated content of %s : %w", valuesFilePath, err)
+		}
+
+		mergedValues, conflicts, err := mergeYAML(baseValues, currentValues, generatedValues)
+		if err != nil {
+			return nil, fmt.Errorf("failed merging template changes into %s : %w", valuesFilePath, err)
+		}
+		for i := range conflicts {
+			conflicts[i].File = valuesFilePath
+		}
+		if len(conflicts) > 0 {
+			return conflicts, nil
+		}
+
+		// Keep the current values file as it is (including its formatting), if nothing has changed.
+		if yamlContentsEqual(mergedValues, currentValues) {
+			mergedValues = currentValues
+		} else {
+			logger.Info("✅ Merged template changes into values file", "file", valuesFilePath)
+		}
+		values = mergedValues
+
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("failed reading argocd-app values file %s : %w", valuesFilePath, err)
+	}
+
+	if err = os.WriteFile(valuesFilePath, values, 0644); err != nil {
+		return nil, fmt.Errorf("failed writing argocd-app values file %s : %w", valuesFilePath, err)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(generatedValuesFilePath), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed creating dir for %s : %w", generatedValuesFilePath, err)
+	}
+	if err = os.WriteFile(generatedValuesFilePath, generatedValues, 0644); err != nil {
+		return nil, fmt.Errorf("failed recording generated content of %s in %s : %w", valuesFilePath, generatedValuesFilePath, err)
 	}
+	return nil, nil
 }
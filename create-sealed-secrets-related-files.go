@@ -1,59 +1,124 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rsa"
 	"fmt"
-	"html/template"
-	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
 )
 
-type SealedSecretArgocdRepoCredentialsTemplateValues struct {
-	Name     string
-	Password string
-	Type     string
-	URL      string
-	Username string
+type (
+	SealedSecretArgocdRepoCredentialsTemplateValues struct {
+		Name     string
+		Password string
+		Type     string
+		URL      string
+		Username string
+	}
+
+	SealedSecretObmondoClientCertTemplateValues struct {
+		ClientCert string
+		ClientKey  string
+	}
+)
+
+// createSealedSecretsRelatedFiles generates the Sealed Secret files, sealing them with the given
+// public key. The plaintext Kubernetes Secrets are only kept in memory. If publicKey is nil (in
+// dry-run mode), the Kubernetes Secrets are written with their values redacted.
+func createSealedSecretsRelatedFiles(logger *slog.Logger, clusterDir string, publicKey *rsa.PublicKey) error {
+	// ArgoCD needs credentials to watch the kubeaid-config repo.
+	err := createSealedSecretFile(
+		logger,
+		"sealed-secrets/argo-cd/kubeaid-config.yaml",
+		fmt.Sprintf("%s/sealed-secrets/argo-cd/kubeaid-config.yaml", clusterDir),
+		SealedSecretArgocdRepoCredentialsTemplateValues{
+			Name: config.ArgoCD.RepoName,
+			URL:  config.KubeaidConfigRepoURL,
+			Type: config.ArgoCD.RepoType,
+
+			Username: config.ArgoCD.RepoUsername,
+			Password: config.ArgoCD.RepoAuthToken,
+		},
+		publicKey,
+	)
+	if err != nil {
+		return err
+	}
+
+	// The Obmondo K8s agent authenticates to Obmondo using the customer's client certificate.
+	if config.ConnectObmondo {
+		clientCert, err := readFile(config.Obmondo.ClientCertFile)
+		if err != nil {
+			return err
+		}
+		clientKey, err := readFile(config.Obmondo.ClientKeyFile)
+		if err != nil {
+			return err
+		}
+
+		return createSealedSecretFile(
+			logger,
+			"sealed-secrets/obmondo/obmondo-clientcert.yaml",
+			fmt.Sprintf("%s/sealed-secrets/obmondo/obmondo-clientcert.yaml", clusterDir),
+			SealedSecretObmondoClientCertTemplateValues{
+				ClientCert: clientCert,
+				ClientKey:  clientKey,
+			},
+			publicKey,
+		)
+	}
+	return nil
 }
 
-func createSealedSecretsRelatedFiles(clusterDir string) {
-	sealedSecretDir := fmt.Sprintf("%s/sealed-secrets/argo-cd", clusterDir)
+// createSealedSecretFile executes the given Kubernetes Secret template in memory, seals the
+// resulting Kubernetes Secret with the given public key and writes the Sealed Secret to
+// sealedSecretFilePath.
+func createSealedSecretFile(logger *slog.Logger, secretTemplateFilePath, sealedSecretFilePath string, templateValues any, publicKey *rsa.PublicKey) error {
+	sealedSecretDir := filepath.Dir(sealedSecretFilePath)
 	if err := os.MkdirAll(sealedSecretDir, os.ModePerm); err != nil {
-		log.Fatalf("❌ Failed creating %s in kubeaid-config repo : %v", sealedSecretDir, err)
+		return fmt.Errorf("failed creating %s in kubeaid-config repo : %w", sealedSecretDir, err)
 	}
 
-	sealedSecretArgocdRepoCredentialsFilePath := fmt.Sprintf("%s/sealed-secrets/argo-cd/kubeaid-config.yaml", clusterDir)
-	sealedSecretArgocdRepoCredentialsFile, err := os.Create(sealedSecretArgocdRepoCredentialsFilePath)
+	secretTemplate, err := parseTemplates(secretTemplateFilePath)
 	if err != nil {
-		log.Fatalf("❌ Failed creating Sealed Secrets ArgoCD repo credentials file at %s : %v", sealedSecretArgocdRepoCredentialsFilePath, err)
+		return fmt.Errorf("failed parsing Kubernetes Secret template file at %s : %w", secretTemplateFilePath, err)
 	}
-	sealedSecretArgocdRepoCredentialsTemplate, err := template.ParseFiles("k8s/cluster/sealed-secrets/argo-cd/kubeaid-config.yaml")
-	if err != nil {
-		log.Fatalf("❌ Failed parsing Sealed Secrets ArgoCD repo credentials template file at %s : %v", sealedSecretArgocdRepoCredentialsFilePath, err)
-	}
-	if err = sealedSecretArgocdRepoCredentialsTemplate.Execute(sealedSecretArgocdRepoCredentialsFile, SealedSecretArgocdRepoCredentialsTemplateValues{
-		Name: encodeStringToBase64(config.ArgoCD.RepoName),
-		URL:  encodeStringToBase64(config.KubeaidConfigRepoURL),
-		Type: encodeStringToBase64(config.ArgoCD.RepoType),
-
-		Username: encodeStringToBase64(config.ArgoCD.RepoUsername),
-		Password: encodeStringToBase64(config.ArgoCD.RepoAuthToken),
-	}); err != nil {
-		log.Fatalf("❌ Failed exeuting Sealed Secrets ArgoCD repo credentials template : %v", err)
-	}
-
-	kubesealCmd :=
-		parseCommand(fmt.Sprintf(`
-			kubeseal \
-				--kubeconfig %s \
-				--controller-name sealed-secrets --controller-namespace kube-system \
-				--secret-file %s --sealed-secret-file %s
-		`, config.ManagementClusterKubeconfig, sealedSecretArgocdRepoCredentialsFilePath, sealedSecretArgocdRepoCredentialsFilePath))
-	log.Printf("Executing kubeseal command : %v", kubesealCmd)
-	output, err := kubesealCmd.CombinedOutput()
+	secretManifest := &bytes.Buffer{}
+	if err = secretTemplate.Execute(secretManifest, templateValues); err != nil {
+		return fmt.Errorf("failed exeuting Kubernetes Secret template %s : %w", secretTemplateFilePath, err)
+	}
+
+	// The plaintext Kubernetes Secret must never be written to disk. So without a public key to seal
+	// it with, we can only write it after redacting its values.
+	if publicKey == nil {
+		redactedSecretManifest, err := redactSecret(secretManifest.Bytes())
+		if err != nil {
+			return fmt.Errorf("failed redacting Kubernetes Secret : %w", err)
+		}
+		logger.Info("⏭️ Skipping sealing in dry-run mode. The file contains the Kubernetes Secret with redacted values", "file", sealedSecretFilePath)
+		if err = os.WriteFile(sealedSecretFilePath, redactedSecretManifest, 0644); err != nil {
+			return fmt.Errorf("failed writing Kubernetes Secret file at %s : %w", sealedSecretFilePath, err)
+		}
+		return nil
+	}
+
+	// Sealing is non-deterministic. So when upgrading the cluster, existing Sealed Secrets are kept
+	// as they are (unless asked to reseal them), to avoid committing changes which aren't real.
+	if _, err := os.Stat(sealedSecretFilePath); err == nil && !resealSecrets {
+		logger.Info("⏭️ Keeping existing Sealed Secret file", "file", sealedSecretFilePath)
+		return nil
+	}
+
+	sealedSecretManifest, err := sealSecret(secretManifest.Bytes(), publicKey)
 	if err != nil {
-		log.Fatal("❌ Failed generating Sealed Secret from Kubernetes Secret using kubeseal", err)
+		return fmt.Errorf("failed generating Sealed Secret from Kubernetes Secret : %w", err)
+	}
+	if err = os.WriteFile(sealedSecretFilePath, sealedSecretManifest, 0644); err != nil {
+		return fmt.Errorf("failed writing Sealed Secret file at %s : %w", sealedSecretFilePath, err)
 	}
-	log.Print(string(output))
 
-	log.Printf("✅ Created Sealed Secrets ArgoCD repo credentials file at %s", sealedSecretArgocdRepoCredentialsFilePath)
+	logger.Info("✅ Created Sealed Secret file", "file", sealedSecretFilePath)
+	return nil
 }
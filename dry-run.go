@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// renderDryRun generates the cluster directories inside outputDir and prints the generated files,
+// without cloning / pushing to the kubeaid-config repo or talking to the clusters.
+func renderDryRun(outputDir string) error {
+	if len(outputDir) == 0 {
+		outputDir = tempDirPath + "/output"
+	}
+	slog.Info("📁 Rendering files", "dir", outputDir)
+
+	for _, clusterConfig := range clusterConfigs {
+		config = clusterConfig
+		if err := renderClusterDir(slog.Default().With("cluster", config.ClusterName), outputDir); err != nil {
+			return err
+		}
+	}
+
+	if err := printDirTree(outputDir); err != nil {
+		return err
+	}
+
+	slog.Info("💫 Finished rendering files", "dir", outputDir)
+	return nil
+}
+
+// renderClusterDir generates the cluster directory of the cluster config is set to, inside
+// outputDir.
+func renderClusterDir(logger *slog.Logger, outputDir string) error {
+	clusterDir := fmt.Sprintf("%s/k8s/%s", outputDir, config.ClusterName)
+	if err := os.MkdirAll(clusterDir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed creating cluster dir %s : %w", clusterDir, err)
+	}
+
+	if err := resolveKubeaidRevision(context.Background(), logger, nil); err != nil {
+		return err
+	}
+
+	// The kubeaid-config repo isn't cloned in dry-run mode, so we don't know its default branch.
+	if err := createArgoCDRelatedFiles(logger, clusterDir, "HEAD", nil); err != nil {
+		return err
+	}
+
+	// Secrets can be sealed offline, if the Sealed Secrets controller's certificate is provided.
+	var sealedSecretsPublicKey *rsa.PublicKey
+	if len(config.SealedSecrets.CertFile) > 0 {
+		var err error
+		if sealedSecretsPublicKey, err = getSealedSecretsPublicKey(context.Background(), logger, nil); err != nil {
+			return err
+		}
+	}
+	if err := createSealedSecretsRelatedFiles(logger, clusterDir, sealedSecretsPublicKey); err != nil {
+		return err
+	}
+
+	// The KubeAid repo isn't accessed in dry-run mode, so the commit isn't known.
+	return writeClusterLockfile(logger, clusterDir, "")
+}
+
+// printDirTree prints the path (relative to dir) and the contents of each file in dir, to stdout.
+func printDirTree(dir string) error {
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("--- %s\n%s\n", relativePath, contents)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed printing files in %s : %w", dir, err)
+	}
+	return nil
+}
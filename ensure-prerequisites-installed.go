@@ -1,77 +1,382 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
 
-	"github.com/charmbracelet/huh"
+	"golang.org/x/mod/semver"
 )
 
-type InstallationCheck struct {
-	name                     string
-	macOSInstallationCommand *exec.Cmd
-}
+type (
+	// Prerequisite is a CLI tool required by the script. If it isn't installed, the script can
+	// install it, by downloading the pinned release's archive for the current OS / arch.
+	Prerequisite struct {
+		name    string
+		version string
 
-var installationChecks = []InstallationCheck{
-	{
-		name:                     "kubectl",
-		macOSInstallationCommand: parseCommand("brew install kubectl"),
-	},
-	{
-		name:                     "jsonnet",
-		macOSInstallationCommand: parseCommand("brew install jsonnet"),
-	},
+		// Command printing the installed version, which the first submatch of versionRegex extracts
+		// from its output. Tools without a version command are only checked for being installed.
+		versionCommand string
+		versionRegex   *regexp.Regexp
+		// Semver constraints (comma separated, like ">= v0.20.0, < v1.0.0") the installed version must
+		// satisfy.
+		versionConstraint string
+
+		// Path of the release's downloads (relative to the download server), containing the archives.
+		releasePath string
+		// Archive (a tarball containing the binary) for each supported <os>/<arch>.
+		archives map[string]string
+		// SHA256 checksum of each archive, copied from the checksums file published with the release.
+		// They're pinned here, since checksums downloaded along with the archives (for e.g. from a
+		// mirror) could have been tampered with as well. Archives without a pinned checksum don't get
+		// installed.
+		checksums map[string]string
+	}
+
+	// PrerequisiteStatus is the outcome of checking whether a prerequisite is installed, in a version
+	// satisfying its constraint.
+	PrerequisiteStatus struct {
+		// Empty if the prerequisite isn't installed.
+		foundVersion string
+		ok           bool
+	}
+)
+
+var prerequisites = []Prerequisite{
 	{
-		name:                     "kubeseal",
-		macOSInstallationCommand: parseCommand("brew install kubeseal"),
+		name:    "jsonnet",
+		version: "v0.21.0",
+
+		versionCommand:    "jsonnet --version",
+		versionRegex:      regexp.MustCompile(`v(\d+\.\d+\.\d+)`),
+		versionConstraint: ">= v0.20.0",
+
+		releasePath: "/google/go-jsonnet/releases/download/v0.21.0",
+		archives: map[string]string{
+			"linux/amd64":  "go-jsonnet_Linux_x86_64.tar.gz",
+			"linux/arm64":  "go-jsonnet_Linux_arm64.tar.gz",
+			"darwin/amd64": "go-jsonnet_Darwin_x86_64.tar.gz",
+			"darwin/arm64": "go-jsonnet_Darwin_arm64.tar.gz",
+		},
+		// To be copied from checksums.txt of the release. Until then, jsonnet isn't installed
+		// automatically.
+		checksums: map[string]string{},
 	},
 	{
-		name: "gojsontoyaml",
-		macOSInstallationCommand: parseCommand(fmt.Sprintf(`
-			cd %s && \
-			mkdir temp && \
-			cd temp && \
-			wget https://github.com/brancz/gojsontoyaml/releases/download/v0.1.0/gojsontoyaml_0.1.0_darwin_arm64.tar.gz && \
-			tar -xvzf gojsontoyaml_0.1.0_darwin_arm64.tar.gz && \
-			chmod +x gojsontoyaml && \
-			sudo mkdir -p /usr/local/bin && \
-			sudo mv ./gojsontoyaml /usr/local/bin
-		`, tempDirPath)),
+		name:    "gojsontoyaml",
+		version: "v0.1.0",
+
+		releasePath: "/brancz/gojsontoyaml/releases/download/v0.1.0",
+		archives: map[string]string{
+			"linux/amd64":  "gojsontoyaml_0.1.0_linux_amd64.tar.gz",
+			"linux/arm64":  "gojsontoyaml_0.1.0_linux_arm64.tar.gz",
+			"darwin/amd64": "gojsontoyaml_0.1.0_darwin_amd64.tar.gz",
+			"darwin/arm64": "gojsontoyaml_0.1.0_darwin_arm64.tar.gz",
+		},
+		// To be copied from gojsontoyaml_0.1.0_checksums.txt of the release. Until then, gojsontoyaml
+		// isn't installed automatically.
+		checksums: map[string]string{},
 	},
 }
 
-func ensurePrerequisitesInstalled() {
-	log.Println("👀 Checking whether prerequisites are installed or not")
+const (
+	// Dir (relative to the home dir) where the prerequisites get installed. No root privileges are
+	// required to write to it.
+	toolsDirRelativePath = ".kubeaid/bin"
+
+	defaultDownloadURL = "https://github.com"
+	// Environment variable pointing to a mirror of the download server (having the same layout). For
+	// e.g. in air-gapped environments.
+	downloadMirrorEnvVar = "KUBEAID_DOWNLOAD_MIRROR"
+
+	downloadTimeout = 5 * time.Minute
+)
+
+// Found versions of prerequisites, which are installed but whose version isn't known.
+const (
+	unknownVersion   = "unknown"
+	unversionedFound = "installed"
+)
+
+func ensurePrerequisitesInstalled() error {
+	slog.Info("👀 Checking whether prerequisites are installed or not")
+
+	// Tools installed by a previous run are picked up from the tools dir. The kube-prometheus build
+	// script finds them there as well.
+	toolsDir, err := getToolsDir()
+	if err != nil {
+		return err
+	}
+	os.Setenv("PATH", toolsDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	prerequisiteStatuses := map[string]PrerequisiteStatus{}
+	for _, prerequisite := range prerequisites {
+		if prerequisiteStatuses[prerequisite.name], err = checkPrerequisite(prerequisite); err != nil {
+			return err
+		}
+	}
+	printPrerequisiteStatuses(prerequisiteStatuses)
+
+	for _, prerequisite := range prerequisites {
+		status := prerequisiteStatuses[prerequisite.name]
+		if status.ok {
+			continue
+		}
+
+		action, prerequisiteErr := "install", ErrPrerequisiteMissing
+		if len(status.foundVersion) == 0 {
+			slog.Error("❌ Prerequisite isn't installed in your system", "prerequisite", prerequisite.name)
+		} else {
+			action, prerequisiteErr = "upgrade", ErrPrerequisiteOutdated
+			slog.Error("❌ Prerequisite is outdated", "prerequisite", prerequisite.name, "found", status.foundVersion, "required", prerequisite.versionConstraint)
+		}
+
+		platform := fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH)
+		if !slices.Contains(getInstallablePlatforms(prerequisite), platform) {
+			return errorf(exitCodePrerequisites, "%w : %s can't be installed automatically on %s. Please %s it and rerun the script", prerequisiteErr, prerequisite.name, platform, action)
+		}
+
+		if !confirm(fmt.Sprintf("Should I %s %s to %s (in %s) for you?", action, prerequisite.name, prerequisite.version, toolsDir)) {
+			return errorf(exitCodePrerequisites, "%w : please %s %s and rerun the script", prerequisiteErr, action, prerequisite.name)
+		}
+
+		if err := installPrerequisite(prerequisite, platform, toolsDir); err != nil {
+			return errorf(exitCodePrerequisites, "failed installing %s : %w", prerequisite.name, err)
+		}
+
+		// Another installation may still take precedence, if the tools dir isn't first in PATH.
+		if status, err = checkPrerequisite(prerequisite); err != nil {
+			return err
+		}
+		if !status.ok {
+			return errorf(exitCodePrerequisites, "%w : installed %s %s into %s, but version %s is still being picked up. Please check your PATH", prerequisiteErr, prerequisite.name, prerequisite.version, toolsDir, status.foundVersion)
+		}
+		slog.Info("✅ Installed prerequisite", "prerequisite", prerequisite.name, "version", prerequisite.version, "dir", toolsDir)
+	}
+	return nil
+}
+
+// checkPrerequisite checks whether the prerequisite is installed, and whether its version satisfies
+// the version constraint.
+func checkPrerequisite(prerequisite Prerequisite) (PrerequisiteStatus, error) {
+	if _, err := exec.LookPath(prerequisite.name); err != nil {
+		return PrerequisiteStatus{}, nil
+	}
+	if len(prerequisite.versionCommand) == 0 {
+		return PrerequisiteStatus{foundVersion: unversionedFound, ok: true}, nil
+	}
+
+	// A version which can't be determined, is treated as not satisfying the constraint.
+	output, err := parseCommand(prerequisite.versionCommand).CombinedOutput()
+	if err != nil {
+		return PrerequisiteStatus{foundVersion: unknownVersion}, nil
+	}
+	submatches := prerequisite.versionRegex.FindStringSubmatch(string(output))
+	if len(submatches) < 2 || !semver.IsValid("v"+submatches[1]) {
+		return PrerequisiteStatus{foundVersion: unknownVersion}, nil
+	}
+	foundVersion := "v" + submatches[1]
+
+	ok, err := satisfiesVersionConstraint(foundVersion, prerequisite.versionConstraint)
+	if err != nil {
+		return PrerequisiteStatus{}, fmt.Errorf("invalid version constraint %s of %s : %w", prerequisite.versionConstraint, prerequisite.name, err)
+	}
+	return PrerequisiteStatus{foundVersion: foundVersion, ok: ok}, nil
+}
+
+// Matches a single semver constraint, like >= v0.20.0.
+var versionConstraintRegex = regexp.MustCompile(`^(>=|<=|>|<|=|!=)?\s*v?(\S+)$`)
+
+// satisfiesVersionConstraint returns whether the version satisfies all the comma separated
+// constraints.
+func satisfiesVersionConstraint(version, constraints string) (bool, error) {
+	for _, constraint := range strings.Split(constraints, ",") {
+		submatches := versionConstraintRegex.FindStringSubmatch(strings.TrimSpace(constraint))
+		if submatches == nil || !semver.IsValid("v"+submatches[2]) {
+			return false, fmt.Errorf("invalid constraint %s", constraint)
+		}
+
+		comparison := semver.Compare(version, "v"+submatches[2])
+		var satisfied bool
+		switch submatches[1] {
+		case ">=":
+			satisfied = comparison >= 0
+		case "<=":
+			satisfied = comparison <= 0
+		case ">":
+			satisfied = comparison > 0
+		case "<":
+			satisfied = comparison < 0
+		case "!=":
+			satisfied = comparison != 0
+		default:
+			satisfied = comparison == 0
+		}
+		if !satisfied {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// printPrerequisiteStatuses prints the found and required versions of the prerequisites, as a table.
+// When logging in JSON, they're logged instead.
+func printPrerequisiteStatuses(prerequisiteStatuses map[string]PrerequisiteStatus) {
+	tabWriter := tabwriter.NewWriter(logRedactor, 0, 0, 2, ' ', 0)
+	if logFormat == logFormatText {
+		fmt.Fprintln(tabWriter, "PREREQUISITE\tFOUND\tREQUIRED\tSTATUS")
+	}
+	for _, prerequisite := range prerequisites {
+		status := prerequisiteStatuses[prerequisite.name]
 
-	for _, installationCheck := range installationChecks {
-		if _, err := exec.Command("which", installationCheck.name).CombinedOutput(); err == nil {
+		foundVersion, requiredVersion, statusMessage := status.foundVersion, prerequisite.versionConstraint, "OK"
+		if len(foundVersion) == 0 {
+			foundVersion = "-"
+		}
+		if len(requiredVersion) == 0 {
+			requiredVersion = "any"
+		}
+		switch {
+		case len(status.foundVersion) == 0:
+			statusMessage = "Missing"
+		case !status.ok:
+			statusMessage = "Outdated"
+		// The prerequisite doesn't print its version, so only its presence is checked.
+		case status.foundVersion == unversionedFound:
+			statusMessage = "OK (version not checked)"
+		}
+		if logFormat == logFormatJSON {
+			slog.Info("👀 Checked prerequisite", "prerequisite", prerequisite.name, "found", status.foundVersion, "required", requiredVersion, "status", statusMessage)
 			continue
 		}
+		fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%s\n", prerequisite.name, foundVersion, requiredVersion, statusMessage)
+	}
+	tabWriter.Flush()
+}
+
+func getToolsDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed determining home dir : %w", err)
+	}
+	return filepath.Join(homeDir, toolsDirRelativePath), nil
+}
+
+// getInstallablePlatforms returns the platforms, for which the prerequisite has an archive with a
+// pinned checksum.
+func getInstallablePlatforms(prerequisite Prerequisite) []string {
+	installablePlatforms := []string{}
+	for _, platform := range slices.Sorted(maps.Keys(prerequisite.archives)) {
+		if len(prerequisite.checksums[platform]) > 0 {
+			installablePlatforms = append(installablePlatforms, platform)
+		}
+	}
+	return installablePlatforms
+}
 
-		log.Printf("❌ %s isn't installed in your system", installationCheck.name)
+// installPrerequisite downloads the prerequisite's archive for the given platform, verifies it
+// against the pinned checksum and extracts the binary into toolsDir.
+func installPrerequisite(prerequisite Prerequisite, platform, toolsDir string) error {
+	archive, expectedChecksum := prerequisite.archives[platform], prerequisite.checksums[platform]
+	if len(archive) == 0 || len(expectedChecksum) == 0 {
+		return fmt.Errorf("no archive with a pinned checksum for %s", platform)
+	}
+
+	downloadURL := defaultDownloadURL
+	if mirrorURL, ok := os.LookupEnv(downloadMirrorEnvVar); ok {
+		downloadURL = strings.TrimSuffix(mirrorURL, "/")
+	}
+	archiveURL := downloadURL + path.Join(prerequisite.releasePath, archive)
+
+	slog.Info("👀 Downloading", "url", archiveURL)
+	archiveContents, err := download(archiveURL)
+	if err != nil {
+		return err
+	}
+	if checksum := sha256.Sum256(archiveContents); hex.EncodeToString(checksum[:]) != strings.ToLower(expectedChecksum) {
+		return fmt.Errorf("checksum of %s is %x, instead of %s", archiveURL, checksum, expectedChecksum)
+	}
+
+	if err = os.MkdirAll(toolsDir, os.ModePerm); err != nil {
+		return err
+	}
+	return extractBinary(archiveContents, prerequisite.name, filepath.Join(toolsDir, prerequisite.name))
+}
+
+func download(url string) ([]byte, error) {
+	client := &http.Client{Timeout: downloadTimeout}
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed downloading %s : %w", url, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed downloading %s : %s", url, response.Status)
+	}
+	contents, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed downloading %s : %w", url, err)
+	}
+	return contents, nil
+}
 
-		var install bool
-		huh.NewSelect[bool]().
-			Title("Should I install it for you?").
-			Options(
-				huh.NewOption("yes", true),
-				huh.NewOption("no", false),
-			).
-			Value(&install).
-			Run()
+// extractBinary extracts the binary with the given name from the tarball, to destinationPath. It's
+// written to a temp file first, so a failed extraction never leaves a broken binary behind.
+func extractBinary(tarball []byte, binaryName, destinationPath string) error {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(tarball))
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
 
-		if !install {
-			log.Fatalf("❌ Please install %s and rerun the script", installationCheck.name)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%s not found in the archive", binaryName)
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || path.Base(header.Name) != binaryName {
+			continue
 		}
 
-		log.Printf("Installing %s, by executing command : %v ....", installationCheck.name, installationCheck.macOSInstallationCommand)
-		output, err := installationCheck.macOSInstallationCommand.CombinedOutput()
-		log.Print(string(output))
+		tempFile, err := os.CreateTemp(filepath.Dir(destinationPath), binaryName+"-*")
 		if err != nil {
-			log.Fatalf("❌ Failed installing %s : %v", installationCheck.name, err)
+			return err
 		}
+		defer os.Remove(tempFile.Name())
 
-		log.Printf("✅ Installed %s", installationCheck.name)
+		_, err = io.Copy(tempFile, tarReader)
+		if closeErr := tempFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if err = os.Chmod(tempFile.Name(), 0755); err != nil {
+			return err
+		}
+		return os.Rename(tempFile.Name(), destinationPath)
 	}
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testBinaryContents = "#!/bin/sh\necho v0.21.0\n"
+
+// createTarball returns a gzipped tarball containing the given files.
+func createTarball(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	tarball := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(tarball)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for name, contents := range files {
+		if err := tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tarball.Bytes()
+}
+
+func getSHA256Checksum(contents []byte) string {
+	checksum := sha256.Sum256(contents)
+	return hex.EncodeToString(checksum[:])
+}
+
+func TestInstallPrerequisite(t *testing.T) {
+	archive := createTarball(t, map[string]string{
+		"LICENSE":           "license",
+		"jsonnet-0/jsonnet": testBinaryContents,
+	})
+	archiveWithoutBinary := createTarball(t, map[string]string{"LICENSE": "license"})
+
+	// Fake download server, with the same layout as the real one.
+	downloadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/releases/v0.21.0/jsonnet_linux_amd64.tar.gz":
+			w.Write(archive)
+		case "/releases/v0.21.0/jsonnet_darwin_arm64.tar.gz":
+			w.Write(archiveWithoutBinary)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer downloadServer.Close()
+	t.Setenv(downloadMirrorEnvVar, downloadServer.URL)
+
+	prerequisite := Prerequisite{
+		name:        "jsonnet",
+		version:     "v0.21.0",
+		releasePath: "/releases/v0.21.0",
+		archives: map[string]string{
+			"linux/amd64":  "jsonnet_linux_amd64.tar.gz",
+			"linux/arm64":  "jsonnet_linux_arm64.tar.gz",
+			"darwin/arm64": "jsonnet_darwin_arm64.tar.gz",
+			"darwin/amd64": "jsonnet_darwin_amd64.tar.gz",
+		},
+		checksums: map[string]string{
+			"linux/amd64":  getSHA256Checksum(archive),
+			"linux/arm64":  getSHA256Checksum([]byte("something else")),
+			"darwin/arm64": getSHA256Checksum(archiveWithoutBinary),
+		},
+	}
+
+	testCases := map[string]struct {
+		platform      string
+		expectSuccess bool
+	}{
+		"checksum match":        {platform: "linux/amd64", expectSuccess: true},
+		"checksum mismatch":     {platform: "linux/arm64"},
+		"missing checksum":      {platform: "darwin/amd64"},
+		"missing platform":      {platform: "windows/amd64"},
+		"binary not in archive": {platform: "darwin/arm64"},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("HOME", t.TempDir())
+			toolsDir, err := getToolsDir()
+			if err != nil {
+				t.Fatal(err)
+			}
+			binaryPath := filepath.Join(toolsDir, prerequisite.name)
+
+			err = installPrerequisite(prerequisite, testCase.platform, toolsDir)
+			if !testCase.expectSuccess {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				// A failed installation must not leave anything behind, which could get picked up.
+				if _, err := os.Stat(binaryPath); !os.IsNotExist(err) {
+					t.Errorf("expected %s to not exist", binaryPath)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			contents, err := os.ReadFile(binaryPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(contents) != testBinaryContents {
+				t.Errorf("unexpected contents of %s : %q", binaryPath, contents)
+			}
+			fileInfo, err := os.Stat(binaryPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fileInfo.Mode().Perm()&0100 == 0 {
+				t.Errorf("expected %s to be executable, found mode %s", binaryPath, fileInfo.Mode())
+			}
+		})
+	}
+}
+
+func TestGetInstallablePlatforms(t *testing.T) {
+	prerequisite := Prerequisite{
+		archives: map[string]string{
+			"linux/amd64":  "a.tar.gz",
+			"darwin/arm64": "b.tar.gz",
+		},
+		checksums: map[string]string{
+			"linux/amd64": "0123",
+			"linux/arm64": "4567",
+		},
+	}
+	installablePlatforms := getInstallablePlatforms(prerequisite)
+	if len(installablePlatforms) != 1 || installablePlatforms[0] != "linux/amd64" {
+		t.Errorf("expected only linux/amd64 to be installable, found %v", installablePlatforms)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Exit codes, which let CI pipelines tell the kinds of failures apart. Other failures exit with
+// exitCodeFailure.
+const (
+	exitCodeFailure = 1
+	// Invalid config file or flags (the flag package exits with 2 as well).
+	exitCodeConfig = 2
+	// Missing or outdated prerequisites.
+	exitCodePrerequisites = 3
+	// Failures cloning, committing to or pushing to a git repo, or opening / merging the PR.
+	exitCodeGit = 4
+	// Failures talking to the cluster.
+	exitCodeCluster = 5
+)
+
+// Failures, which callers may want to tell apart (using errors.Is).
+var (
+	ErrAuth                 = errors.New("git authentication failed")
+	ErrBranchExists         = errors.New("branch already exists")
+	ErrClusterDirExists     = errors.New("cluster dir already exists")
+	ErrClusterDirNotFound   = errors.New("cluster dir doesn't exist")
+	ErrPrerequisiteMissing  = errors.New("prerequisite isn't installed")
+	ErrPrerequisiteOutdated = errors.New("prerequisite is outdated")
+	ErrInvalidConfig        = errors.New("invalid config")
+	ErrValuesFilesConflicts = errors.New("conflicts between your edits and the template changes")
+	ErrPullRequestNotMerged = errors.New("PR didn't get merged")
+	ErrPullRequestClosed    = errors.New("PR got closed without being merged")
+	ErrStateFileMismatch    = errors.New("state file belongs to other cluster(s)")
+)
+
+// ExitCodeError attaches the exit code, the script should exit with, to an error. It's transparent
+// otherwise : its message and what it wraps are those of the error.
+type ExitCodeError struct {
+	exitCode int
+	err      error
+}
+
+func (e *ExitCodeError) Error() string { return e.err.Error() }
+
+func (e *ExitCodeError) Unwrap() error { return e.err }
+
+// errorf is like fmt.Errorf, but the script exits with the given exit code, if the error makes
+// it to main.
+func errorf(exitCode int, format string, args ...any) error {
+	return &ExitCodeError{exitCode: exitCode, err: fmt.Errorf(format, args...)}
+}
+
+// getExitCode returns the exit code of the outermost ExitCodeError the error wraps.
+func getExitCode(err error) int {
+	var exitCodeError *ExitCodeError
+	if errors.As(err, &exitCodeError) {
+		return exitCodeError.exitCode
+	}
+	return exitCodeFailure
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type (
+	// GitForge is a git platform (like GitHub), where the kubeaid-config repo is hosted.
+	GitForge interface {
+		CreatePullRequest(ctx context.Context, options PullRequestOptions) (*PullRequest, error)
+		// IsPullRequestMerged returns ErrPullRequestClosed if the PR got closed without being merged.
+		IsPullRequestMerged(ctx context.Context, number int) (bool, error)
+	}
+
+	PullRequestOptions struct {
+		SourceBranch,
+		TargetBranch,
+		Title,
+		Description string
+	}
+
+	PullRequest struct {
+		Number int
+		URL    string
+	}
+)
+
+const (
+	ForgeTypeGitHub = "github"
+	ForgeTypeGitLab = "gitlab"
+	ForgeTypeGitea  = "gitea"
+)
+
+// getGitForge returns the git forge hosting the kubeaid-config repo, or nil if none is
+// configured.
+func getGitForge() (GitForge, error) {
+	if len(config.Forge.Type) == 0 {
+		return nil, nil
+	}
+
+	repoHost, repoPath, err := parseRepoURL(config.KubeaidConfigRepoURL)
+	if err != nil {
+		return nil, errorf(exitCodeConfig, "failed parsing kubeaid-config repo URL %s : %w", config.KubeaidConfigRepoURL, err)
+	}
+
+	apiURL := strings.TrimSuffix(config.Forge.APIURL, "/")
+
+	switch config.Forge.Type {
+	case ForgeTypeGitHub:
+		if len(apiURL) == 0 {
+			apiURL = "https://api.github.com"
+			if repoHost != "github.com" {
+				// GitHub Enterprise Server.
+				apiURL = fmt.Sprintf("https://%s/api/v3", repoHost)
+			}
+		}
+		return &GitHub{apiURL: apiURL, repoPath: repoPath, token: config.Forge.Token}, nil
+
+	case ForgeTypeGitLab:
+		if len(apiURL) == 0 {
+			apiURL = fmt.Sprintf("https://%s/api/v4", repoHost)
+		}
+		return &GitLab{apiURL: apiURL, repoPath: repoPath, token: config.Forge.Token}, nil
+
+	case ForgeTypeGitea:
+		if len(apiURL) == 0 {
+			apiURL = fmt.Sprintf("https://%s/api/v1", repoHost)
+		}
+		return &Gitea{apiURL: apiURL, repoPath: repoPath, token: config.Forge.Token}, nil
+
+	default:
+		return nil, errorf(exitCodeConfig, "unsupported forge type '%s'. Supported forge types are %s, %s and %s", config.Forge.Type, ForgeTypeGitHub, ForgeTypeGitLab, ForgeTypeGitea)
+	}
+}
+
+// parseRepoURL returns the host and the path (like obmondo/kubeaid-config) of a git repo, given its
+// HTTP(S), SSH or SCP-like (git@github.com:obmondo/kubeaid-config.git) URL.
+func parseRepoURL(repoURL string) (host, path string, err error) {
+	if !strings.Contains(repoURL, "://") {
+		// SCP-like syntax : [user@]host:path
+		hostPart, pathPart, found := strings.Cut(repoURL, ":")
+		if !found {
+			return "", "", fmt.Errorf("unrecognized repo URL format")
+		}
+		if i := strings.LastIndex(hostPart, "@"); i != -1 {
+			hostPart = hostPart[i+1:]
+		}
+		host, path = hostPart, pathPart
+	} else {
+		parsedURL, err := url.Parse(repoURL)
+		if err != nil {
+			return "", "", err
+		}
+		host, path = parsedURL.Host, parsedURL.Path
+	}
+
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if len(host) == 0 || !strings.Contains(path, "/") {
+		return "", "", fmt.Errorf("repo URL doesn't contain a host and an owner/repo path")
+	}
+	return host, path, nil
+}
+
+// sendForgeAPIRequest sends a JSON request to a forge's REST API, and decodes the JSON response
+// into responseBody.
+func sendForgeAPIRequest(ctx context.Context, method, url string, headers map[string]string, requestBody, responseBody any) error {
+	var body io.Reader
+	if requestBody != nil {
+		requestBodyBytes, err := json.Marshal(requestBody)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(requestBodyBytes)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	responseBodyBytes, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w : %s %s returned status %d : %s", ErrAuth, method, url, response.StatusCode, responseBodyBytes)
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("%s %s returned status %d : %s", method, url, response.StatusCode, responseBodyBytes)
+	}
+
+	if responseBody == nil {
+		return nil
+	}
+	return json.Unmarshal(responseBodyBytes, responseBody)
+}
+
+type GitHub struct {
+	apiURL,
+	repoPath,
+	token string
+}
+
+func (g *GitHub) headers() map[string]string {
+	return map[string]string{
+		"Accept":               "application/vnd.github+json",
+		"Authorization":        "Bearer " + g.token,
+		"X-GitHub-Api-Version": "2022-11-28",
+	}
+}
+
+func (g *GitHub) CreatePullRequest(ctx context.Context, options PullRequestOptions) (*PullRequest, error) {
+	response := struct {
+		Number  int    `json:"number"`
+		HTMLURL string `json:"html_url"`
+	}{}
+	err := sendForgeAPIRequest(ctx, http.MethodPost, fmt.Sprintf("%s/repos/%s/pulls", g.apiURL, g.repoPath), g.headers(),
+		map[string]string{
+			"title": options.Title,
+			"body":  options.Description,
+			"head":  options.SourceBranch,
+			"base":  options.TargetBranch,
+		},
+		&response,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &PullRequest{Number: response.Number, URL: response.HTMLURL}, nil
+}
+
+func (g *GitHub) IsPullRequestMerged(ctx context.Context, number int) (bool, error) {
+	response := struct {
+		State  string `json:"state"`
+		Merged bool   `json:"merged"`
+	}{}
+	if err := sendForgeAPIRequest(ctx, http.MethodGet, fmt.Sprintf("%s/repos/%s/pulls/%d", g.apiURL, g.repoPath, number), g.headers(), nil, &response); err != nil {
+		return false, err
+	}
+	if response.State == "closed" && !response.Merged {
+		return false, fmt.Errorf("%w : PR #%d", ErrPullRequestClosed, number)
+	}
+	return response.Merged, nil
+}
+
+type GitLab struct {
+	apiURL,
+	repoPath,
+	token string
+}
+
+func (g *GitLab) headers() map[string]string {
+	return map[string]string{"PRIVATE-TOKEN": g.token}
+}
+
+// projectURL returns the API URL of the GitLab project. The project is identified by its URL
+// encoded path, since it can be nested inside (sub)groups.
+func (g *GitLab) projectURL() string {
+	return fmt.Sprintf("%s/projects/%s", g.apiURL, url.PathEscape(g.repoPath))
+}
+
+func (g *GitLab) CreatePullRequest(ctx context.Context, options PullRequestOptions) (*PullRequest, error) {
+	response := struct {
+		IID    int    `json:"iid"`
+		WebURL string `json:"web_url"`
+	}{}
+	err := sendForgeAPIRequest(ctx, http.MethodPost, g.projectURL()+"/merge_requests", g.headers(),
+		map[string]string{
+			"title":         options.Title,
+			"description":   options.Description,
+			"source_branch": options.SourceBranch,
+			"target_branch": options.TargetBranch,
+		},
+		&response,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &PullRequest{Number: response.IID, URL: response.WebURL}, nil
+}
+
+func (g *GitLab) IsPullRequestMerged(ctx context.Context, number int) (bool, error) {
+	response := struct {
+		State string `json:"state"`
+	}{}
+	if err := sendForgeAPIRequest(ctx, http.MethodGet, fmt.Sprintf("%s/merge_requests/%d", g.projectURL(), number), g.headers(), nil, &response); err != nil {
+		return false, err
+	}
+	// The state of MRs closed without being merged is closed, and of merged ones is merged.
+	if response.State == "closed" {
+		return false, fmt.Errorf("%w : MR !%d", ErrPullRequestClosed, number)
+	}
+	return response.State == "merged", nil
+}
+
+type Gitea struct {
+	apiURL,
+	repoPath,
+	token string
+}
+
+func (g *Gitea) headers() map[string]string {
+	return map[string]string{"Authorization": "token " + g.token}
+}
+
+func (g *Gitea) CreatePullRequest(ctx context.Context, options PullRequestOptions) (*PullRequest, error) {
+	response := struct {
+		Number  int    `json:"number"`
+		HTMLURL string `json:"html_url"`
+	}{}
+	err := sendForgeAPIRequest(ctx, http.MethodPost, fmt.Sprintf("%s/repos/%s/pulls", g.apiURL, g.repoPath), g.headers(),
+		map[string]string{
+			"title": options.Title,
+			"body":  options.Description,
+			"head":  options.SourceBranch,
+			"base":  options.TargetBranch,
+		},
+		&response,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &PullRequest{Number: response.Number, URL: response.HTMLURL}, nil
+}
+
+func (g *Gitea) IsPullRequestMerged(ctx context.Context, number int) (bool, error) {
+	response := struct {
+		State  string `json:"state"`
+		Merged bool   `json:"merged"`
+	}{}
+	if err := sendForgeAPIRequest(ctx, http.MethodGet, fmt.Sprintf("%s/repos/%s/pulls/%d", g.apiURL, g.repoPath, number), g.headers(), nil, &response); err != nil {
+		return false, err
+	}
+	if response.State == "closed" && !response.Merged {
+		return false, fmt.Errorf("%w : PR #%d", ErrPullRequestClosed, number)
+	}
+	return response.Merged, nil
+}
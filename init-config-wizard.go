@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/charmbracelet/huh"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	gitAuthMethodPassword      = "password"
+	gitAuthMethodSSHPrivateKey = "sshPrivateKey"
+	gitAuthMethodSSHAgent      = "sshAgent"
+
+	secretFieldDescription = "Can also be a reference, like ${NAME}, env:NAME, file:/path or exec:command"
+)
+
+// runInitConfigWizard walks the user through every field of the config, in a multi-page form, and
+// writes the resulting config file.
+func runInitConfigWizard(args []string) error {
+	flagSet := flag.NewFlagSet("init", flag.ContinueOnError)
+	outputFile := flagSet.String("output", "config.yaml", "Path where the generated config file gets written")
+	addLogFlags(flagSet)
+	if err := parseFlags(flagSet, args); err != nil {
+		return err
+	}
+
+	if !isInteractive() {
+		return errorf(exitCodeConfig, "the config wizard needs to be run in a terminal. Write the config file by hand instead (see the README)")
+	}
+
+	if _, err := os.Stat(*outputFile); err == nil {
+		if !confirm(fmt.Sprintf("%s already exists. Should I overwrite it?", *outputFile)) {
+			return fmt.Errorf("not overwriting %s", *outputFile)
+		}
+	}
+
+	wizardConfig := Config{
+		KubeaidRepoURL: "https://github.com/Obmondo/KubeAid",
+
+		ManagementClusterKubeconfig: getDefaultKubeconfigPath(),
+	}
+	wizardConfig.ArgoCD.RepoName = "kubeaid-config"
+	wizardConfig.ArgoCD.RepoType = "git"
+
+	var (
+		gitAuthMethod = gitAuthMethodPassword
+		// The root app always gets deployed, so it isn't an option.
+		defaultNonRootArgocdApps = slices.DeleteFunc(slices.Clone(defaultArgocdApps), func(argocdAppName string) bool {
+			return argocdAppName == "root"
+		})
+		argocdApps = slices.Clone(defaultNonRootArgocdApps)
+	)
+	// The selected apps are in the same (sorted) order as the options.
+	slices.Sort(defaultNonRootArgocdApps)
+
+	form := huh.NewForm(
+		huh.NewGroup(
+			huh.NewInput().
+				Title("Cluster name").
+				Description("Name of the cluster, used as the directory name in the kubeaid-config repo").
+				Value(&wizardConfig.ClusterName).
+				Validate(validateDNS1123Label),
+
+			huh.NewInput().
+				Title("KubeAid repo URL").
+				Value(&wizardConfig.KubeaidRepoURL).
+				Validate(validateGitURL),
+
+			huh.NewInput().
+				Title("kubeaid-config repo URL").
+				Description("Repo where the cluster's files get committed").
+				Value(&wizardConfig.KubeaidConfigRepoURL).
+				Validate(validateGitURL),
+		).Title("Cluster"),
+
+		huh.NewGroup(
+			huh.NewSelect[string]().
+				Title("Git authentication method").
+				Options(
+					huh.NewOption("Username and password (or token)", gitAuthMethodPassword),
+					huh.NewOption("SSH private key file", gitAuthMethodSSHPrivateKey),
+					huh.NewOption("SSH agent", gitAuthMethodSSHAgent),
+				).
+				Value(&gitAuthMethod),
+		).Title("Git"),
+
+		huh.NewGroup(
+			huh.NewInput().
+				Title("Git username").
+				Value(&wizardConfig.Git.Username),
+
+			huh.NewInput().
+				Title("Git password (or token)").
+				Description(secretFieldDescription).
+				EchoMode(huh.EchoModePassword).
+				Value(&wizardConfig.Git.Password).
+				Validate(validateNotEmpty),
+		).
+			Title("Git").
+			WithHideFunc(func() bool { return gitAuthMethod != gitAuthMethodPassword }),
+
+		huh.NewGroup(
+			huh.NewInput().
+				Title("SSH private key file").
+				Value(&wizardConfig.Git.SSHPrivateKey).
+				Validate(validateFileExists),
+
+			huh.NewInput().
+				Title("SSH private key passphrase").
+				Description("Leave empty, if the SSH private key isn't encrypted. "+secretFieldDescription).
+				EchoMode(huh.EchoModePassword).
+				Value(&wizardConfig.Git.Password),
+		).
+			Title("Git").
+			WithHideFunc(func() bool { return gitAuthMethod != gitAuthMethodSSHPrivateKey }),
+
+		huh.NewGroup(
+			huh.NewSelect[string]().
+				Title("Forge hosting the kubeaid-config repo").
+				Description("When specified, the PR gets opened for you").
+				Options(
+					huh.NewOption("None (I'll open the PR myself)", ""),
+					huh.NewOption("GitHub", ForgeTypeGitHub),
+					huh.NewOption("GitLab", ForgeTypeGitLab),
+					huh.NewOption("Gitea", ForgeTypeGitea),
+				).
+				Value(&wizardConfig.Forge.Type),
+		).Title("Forge"),
+
+		huh.NewGroup(
+			huh.NewInput().
+				Title("Forge API URL").
+				Description("Leave empty, to derive it from the kubeaid-config repo URL").
+				Value(&wizardConfig.Forge.APIURL).
+				Validate(optional(validateHTTPURL)),
+
+			huh.NewInput().
+				Title("Forge API token").
+				Description(secretFieldDescription).
+				EchoMode(huh.EchoModePassword).
+				Value(&wizardConfig.Forge.Token).
+				Validate(validateNotEmpty),
+		).
+			Title("Forge").
+			WithHideFunc(func() bool { return len(wizardConfig.Forge.Type) == 0 }),
+
+		huh.NewGroup(
+			huh.NewInput().
+				Title("ArgoCD repo name").
+				Value(&wizardConfig.ArgoCD.RepoName).
+				Validate(validateNotEmpty),
+
+			huh.NewSelect[string]().
+				Title("ArgoCD repo type").
+				Options(huh.NewOptions("git", "helm")...).
+				Value(&wizardConfig.ArgoCD.RepoType),
+
+			huh.NewInput().
+				Title("ArgoCD repo username").
+				Value(&wizardConfig.ArgoCD.RepoUsername),
+
+			huh.NewInput().
+				Title("ArgoCD repo auth token").
+				Description(secretFieldDescription).
+				EchoMode(huh.EchoModePassword).
+				Value(&wizardConfig.ArgoCD.RepoAuthToken),
+
+			huh.NewMultiSelect[string]().
+				Title("ArgoCD apps").
+				Description("The root app always gets deployed").
+				Options(getArgocdAppOptions()...).
+				Value(&argocdApps),
+		).Title("ArgoCD"),
+
+		huh.NewGroup(
+			huh.NewInput().
+				Title("kube-prometheus version").
+				Value(&wizardConfig.KubePrometheusVersion).
+				Validate(validateNotEmpty),
+
+			huh.NewInput().
+				Title("Grafana URL").
+				Value(&wizardConfig.GrafanaURL).
+				Validate(optional(validateHTTPURL)),
+
+			huh.NewConfirm().
+				Title("Connect the cluster to Obmondo?").
+				Value(&wizardConfig.ConnectObmondo),
+		).Title("Monitoring"),
+
+		huh.NewGroup(
+			huh.NewInput().
+				Title("Obmondo client certificate file").
+				Value(&wizardConfig.Obmondo.ClientCertFile).
+				Validate(validateFileExists),
+
+			huh.NewInput().
+				Title("Obmondo client key file").
+				Value(&wizardConfig.Obmondo.ClientKeyFile).
+				Validate(validateFileExists),
+		).
+			Title("Obmondo").
+			WithHideFunc(func() bool { return !wizardConfig.ConnectObmondo }),
+
+		huh.NewGroup(
+			huh.NewInput().
+				Title("Management cluster kubeconfig").
+				Value(&wizardConfig.ManagementClusterKubeconfig).
+				Validate(validateKubeconfig),
+		).Title("Management cluster"),
+
+		huh.NewGroup(
+			huh.NewSelect[string]().
+				Title("Management cluster kube-context").
+				OptionsFunc(func() []huh.Option[string] {
+					return getKubeContextOptions(wizardConfig.ManagementClusterKubeconfig)
+				}, &wizardConfig.ManagementClusterKubeconfig).
+				Value(&wizardConfig.ManagementClusterKubectx).
+				Validate(validateNotEmpty),
+
+			huh.NewInput().
+				Title("Sealed Secrets controller name").
+				Placeholder(defaultSealedSecretsControllerName).
+				Value(&wizardConfig.SealedSecrets.ControllerName),
+
+			huh.NewInput().
+				Title("Sealed Secrets controller namespace").
+				Placeholder(defaultSealedSecretsControllerNamespace).
+				Value(&wizardConfig.SealedSecrets.ControllerNamespace),
+		).Title("Management cluster"),
+	)
+	if err := form.Run(); err != nil {
+		if errors.Is(err, huh.ErrUserAborted) {
+			return errors.New("aborted")
+		}
+		return fmt.Errorf("failed running the config wizard : %w", err)
+	}
+
+	wizardConfig.Git.UseSSHAgentAuth = (gitAuthMethod == gitAuthMethodSSHAgent)
+	if gitAuthMethod != gitAuthMethodSSHPrivateKey {
+		wizardConfig.Git.SSHPrivateKey = ""
+	}
+	if gitAuthMethod == gitAuthMethodSSHAgent {
+		wizardConfig.Git.Password = ""
+	}
+
+	// The defaults are used, when no ArgoCD apps are specified.
+	if !slices.Equal(argocdApps, defaultNonRootArgocdApps) {
+		for _, argocdAppName := range argocdApps {
+			wizardConfig.ArgocdApps = append(wizardConfig.ArgocdApps, ArgocdApp{Name: argocdAppName})
+		}
+	}
+
+	// Catch anything the inline validations can't, like combinations of fields.
+	config = wizardConfig
+	if validationErrors := validateConfig(&config, nil); len(validationErrors) > 0 {
+		for _, validationError := range validationErrors {
+			slog.Error("❌ " + validationError.Error())
+		}
+		return errorf(exitCodeConfig, "%w : found %d error(s) in the generated config", ErrInvalidConfig, len(validationErrors))
+	}
+
+	configFileContents, err := marshalYAML(wizardConfig)
+	if err != nil {
+		return fmt.Errorf("failed marshalling config : %w", err)
+	}
+	// The config file contains credentials.
+	if err = os.WriteFile(*outputFile, configFileContents, 0600); err != nil {
+		return fmt.Errorf("failed writing config file at %s : %w", *outputFile, err)
+	}
+	slog.Info(fmt.Sprintf("✅ Wrote config file. Run the script with --config-file %s", *outputFile), "file", *outputFile)
+	return nil
+}
+
+func getDefaultKubeconfigPath() string {
+	if kubeconfig := os.Getenv("KUBECONFIG"); len(kubeconfig) > 0 {
+		return filepath.SplitList(kubeconfig)[0]
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".kube", "config")
+}
+
+// getKubeContextOptions lists the contexts in the given kubeconfig, with the current context
+// first.
+func getKubeContextOptions(kubeconfigPath string) []huh.Option[string] {
+	kubeconfig, err := clientcmd.LoadFromFile(kubeconfigPath)
+	if err != nil {
+		return nil
+	}
+
+	contexts := []string{}
+	for context := range kubeconfig.Contexts {
+		contexts = append(contexts, context)
+	}
+	slices.Sort(contexts)
+
+	options := []huh.Option[string]{}
+	for _, context := range contexts {
+		option := huh.NewOption(context, context)
+		if context == kubeconfig.CurrentContext {
+			options = slices.Insert(options, 0, option.Selected(true))
+			continue
+		}
+		options = append(options, option)
+	}
+	return options
+}
+
+func getArgocdAppOptions() []huh.Option[string] {
+	argocdAppNames := []string{}
+	for argocdAppName := range argocdAppsCatalogue {
+		if argocdAppName != "root" {
+			argocdAppNames = append(argocdAppNames, argocdAppName)
+		}
+	}
+	slices.Sort(argocdAppNames)
+
+	options := []huh.Option[string]{}
+	for _, argocdAppName := range argocdAppNames {
+		options = append(options, huh.NewOption(argocdAppName, argocdAppName))
+	}
+	return options
+}
+
+func validateNotEmpty(value string) error {
+	if len(value) == 0 {
+		return errors.New("is required")
+	}
+	return nil
+}
+
+func validateFileExists(filePath string) error {
+	if len(filePath) == 0 {
+		return errors.New("is required")
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		return fmt.Errorf("can't be read : %v", err)
+	}
+	return nil
+}
+
+func validateKubeconfig(kubeconfigPath string) error {
+	if err := validateFileExists(kubeconfigPath); err != nil {
+		return err
+	}
+	kubeconfig, err := clientcmd.LoadFromFile(kubeconfigPath)
+	if err != nil {
+		return fmt.Errorf("isn't a valid kubeconfig : %v", err)
+	}
+	if len(kubeconfig.Contexts) == 0 {
+		return errors.New("doesn't contain any context")
+	}
+	return nil
+}
+
+// optional skips the given validation for empty values.
+func optional(validate func(string) error) func(string) error {
+	return func(value string) error {
+		if len(value) == 0 {
+			return nil
+		}
+		return validate(value)
+	}
+}
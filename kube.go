@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// Field manager used for server-side apply.
+	kubeFieldManager = "kubeaid-bootstrap-script"
+
+	// Namespace where ArgoCD (and the ArgoCD apps) live.
+	argocdNamespace = "argocd"
+)
+
+var argocdAppGVR = schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "applications"}
+
+// KubeClient talks to the management cluster.
+type KubeClient struct {
+	restConfig    *rest.Config
+	clientset     kubernetes.Interface
+	dynamicClient dynamic.Interface
+	restMapper    *restmapper.DeferredDiscoveryRESTMapper
+}
+
+// getKubeClient returns a client for the management cluster, using the configured kubeconfig and
+// kube-context. Unlike 'kubectl config use-context', the kubeconfig file isn't modified.
+func getKubeClient(logger *slog.Logger) (*KubeClient, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = config.ManagementClusterKubeconfig
+
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loadingRules,
+		&clientcmd.ConfigOverrides{CurrentContext: config.ManagementClusterKubectx},
+	).ClientConfig()
+	if err != nil {
+		return nil, errorf(exitCodeCluster, "failed loading context %s from the kubeconfig at %s : %w", config.ManagementClusterKubectx, config.ManagementClusterKubeconfig, err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, errorf(exitCodeCluster, "failed creating Kubernetes clientset : %w", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, errorf(exitCodeCluster, "failed creating Kubernetes dynamic client : %w", err)
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return nil, errorf(exitCodeCluster, "failed creating Kubernetes discovery client : %w", err)
+	}
+
+	logger.Info("✅ Using kubeconfig", "context", config.ManagementClusterKubectx, "kubeconfig", config.ManagementClusterKubeconfig)
+	return &KubeClient{
+		restConfig:    restConfig,
+		clientset:     clientset,
+		dynamicClient: dynamicClient,
+		restMapper:    restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)),
+	}, nil
+}
+
+// applyManifestFile server-side applies the Kubernetes object defined in the given manifest file.
+func (k *KubeClient) applyManifestFile(ctx context.Context, manifestFilePath string) error {
+	manifestFile, err := os.Open(manifestFilePath)
+	if err != nil {
+		return err
+	}
+	defer manifestFile.Close()
+
+	object := &unstructured.Unstructured{}
+	if err = yaml.NewYAMLOrJSONDecoder(manifestFile, 4096).Decode(&object.Object); err != nil {
+		return fmt.Errorf("failed decoding manifest : %w", err)
+	}
+
+	return k.applyObject(ctx, object)
+}
+
+// applyObject server-side applies the given Kubernetes object.
+func (k *KubeClient) applyObject(ctx context.Context, object *unstructured.Unstructured) error {
+	gvk := object.GroupVersionKind()
+	mapping, err := k.restMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return fmt.Errorf("failed finding API resource for %s : %w", gvk, err)
+	}
+
+	_, err = k.dynamicClient.Resource(mapping.Resource).Namespace(object.GetNamespace()).
+		Apply(ctx, object.GetName(), object, metaV1.ApplyOptions{
+			FieldManager: kubeFieldManager,
+			Force:        true,
+		})
+	if err != nil {
+		return fmt.Errorf("failed applying %s %s/%s : %w", gvk.Kind, object.GetNamespace(), object.GetName(), err)
+	}
+	return nil
+}
+
+// listArgocdApps returns the ArgoCD apps in the cluster.
+func (k *KubeClient) listArgocdApps(ctx context.Context) ([]unstructured.Unstructured, error) {
+	argocdApps, err := k.dynamicClient.Resource(argocdAppGVR).Namespace(argocdNamespace).List(ctx, metaV1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed listing ArgoCD apps : %w", err)
+	}
+	return argocdApps.Items, nil
+}
+
+// deleteArgocdApp deletes the given ArgoCD app, if it exists. ArgoCD deletes the resources deployed
+// by it, when it has the resources finalizer.
+func (k *KubeClient) deleteArgocdApp(ctx context.Context, logger *slog.Logger, name string) error {
+	err := k.dynamicClient.Resource(argocdAppGVR).Namespace(argocdNamespace).Delete(ctx, name, metaV1.DeleteOptions{})
+	if kubeErrors.IsNotFound(err) {
+		logger.Info("⏭️ ArgoCD app doesn't exist", "app", name)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	gitConfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"golang.org/x/mod/semver"
+)
+
+// kubeaidVersion which pins the KubeAid source to the latest release.
+const kubeaidVersionLatest = "latest"
+
+// kubeaidRevision is the revision of the KubeAid repo, which the ArgoCD apps point to (unless
+// overridden) and kube-prometheus gets built from. It's resolved from config.KubeaidVersion.
+var kubeaidRevision = "HEAD"
+
+var commitHashRegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// resolveKubeaidRevision resolves the configured KubeAid version to a revision. The latest version
+// gets resolved to the latest release tag, by listing the KubeAid repo's remote refs.
+func resolveKubeaidRevision(ctx context.Context, logger *slog.Logger, gitAuthMethod transport.AuthMethod) error {
+	switch config.KubeaidVersion {
+	case "":
+		logger.Warn("⚠️ KubeAid version isn't pinned, so every push to KubeAid gets rolled out to the cluster. Consider setting kubeaidVersion")
+		kubeaidRevision = "HEAD"
+
+	case kubeaidVersionLatest:
+		refs, err := listKubeaidRepoRefs(ctx, gitAuthMethod)
+		if err != nil {
+			return errorf(exitCodeGit, "failed listing refs of KubeAid repo %s : %w", config.KubeaidRepoURL, err)
+		}
+		latestReleaseTag, err := getLatestReleaseTag(refs)
+		if err != nil {
+			return errorf(exitCodeGit, "failed finding the latest release of KubeAid : %w", err)
+		}
+		kubeaidRevision = latestReleaseTag
+		logger.Info("✅ Resolved the latest KubeAid release", "version", kubeaidRevision)
+
+	default:
+		kubeaidRevision = config.KubeaidVersion
+	}
+	return nil
+}
+
+func listKubeaidRepoRefs(ctx context.Context, gitAuthMethod transport.AuthMethod) ([]*plumbing.Reference, error) {
+	remote := git.NewRemote(memory.NewStorage(), &gitConfig.RemoteConfig{
+		Name: "origin",
+		URLs: []string{config.KubeaidRepoURL},
+	})
+	// Annotated tags need to be peeled, to find out the commits they point to.
+	return remote.ListContext(ctx, &git.ListOptions{
+		Auth:          gitAuthMethod,
+		PeelingOption: git.AppendPeeled,
+	})
+}
+
+// getLatestReleaseTag returns the tag of the highest release (ignoring pre-releases), among the
+// given refs. Tags are expected to be semantic versions, with or without the v prefix.
+func getLatestReleaseTag(refs []*plumbing.Reference) (string, error) {
+	latestReleaseTag, latestReleaseVersion := "", ""
+	for _, ref := range refs {
+		if !ref.Name().IsTag() || strings.HasSuffix(ref.Name().String(), "^{}") {
+			continue
+		}
+
+		tag := ref.Name().Short()
+		version := "v" + strings.TrimPrefix(tag, "v")
+		if !semver.IsValid(version) || len(semver.Prerelease(version)) > 0 {
+			continue
+		}
+		if len(latestReleaseVersion) == 0 || semver.Compare(version, latestReleaseVersion) > 0 {
+			latestReleaseTag, latestReleaseVersion = tag, version
+		}
+	}
+
+	if len(latestReleaseTag) == 0 {
+		return "", fmt.Errorf("no release tags found")
+	}
+	return latestReleaseTag, nil
+}
+
+// getKubeaidRepoDir returns the dir, where the KubeAid repo gets cloned to at the KubeAid revision.
+func getKubeaidRepoDir() string {
+	hash := sha256.Sum256([]byte(config.KubeaidRepoURL + "@" + kubeaidRevision))
+	return fmt.Sprintf("%s/kubeaid-%x", tempDirPath, hash[:6])
+}
+
+// getKubeaidCommit returns the KubeAid repo commit the files are generated from. If the KubeAid repo
+// has been cloned (for building kube-prometheus), that's its HEAD. Otherwise, the KubeAid revision
+// gets looked up in the remote refs.
+func getKubeaidCommit(ctx context.Context, gitAuthMethod transport.AuthMethod) (string, error) {
+	if kubeaidRepo, err := git.PlainOpen(getKubeaidRepoDir()); err == nil {
+		headRef, err := kubeaidRepo.Head()
+		if err != nil {
+			return "", errorf(exitCodeGit, "failed getting HEAD ref of KubeAid repo : %w", err)
+		}
+		return headRef.Hash().String(), nil
+	}
+
+	if commitHashRegex.MatchString(kubeaidRevision) {
+		return kubeaidRevision, nil
+	}
+
+	refs, err := listKubeaidRepoRefs(ctx, gitAuthMethod)
+	if err != nil {
+		return "", errorf(exitCodeGit, "failed listing refs of KubeAid repo %s : %w", config.KubeaidRepoURL, err)
+	}
+	refHashes := map[string]plumbing.Hash{}
+	for _, ref := range refs {
+		// The remote HEAD is usually a symbolic ref, pointing to the default branch.
+		if ref.Type() == plumbing.SymbolicReference {
+			continue
+		}
+		refHashes[ref.Name().String()] = ref.Hash()
+	}
+	for _, ref := range refs {
+		if ref.Type() == plumbing.SymbolicReference {
+			refHashes[ref.Name().String()] = refHashes[ref.Target().String()]
+		}
+	}
+
+	// Peeled tags point to commits, unlike annotated tags.
+	for _, refName := range []string{
+		kubeaidRevision,
+		fmt.Sprintf("refs/tags/%s^{}", kubeaidRevision),
+		fmt.Sprintf("refs/tags/%s", kubeaidRevision),
+		fmt.Sprintf("refs/heads/%s", kubeaidRevision),
+	} {
+		if hash, ok := refHashes[refName]; ok && !hash.IsZero() {
+			return hash.String(), nil
+		}
+	}
+	return "", errorf(exitCodeGit, "revision %s not found in KubeAid repo %s", kubeaidRevision, config.KubeaidRepoURL)
+}
+
+// checkoutKubeaidRevision checks out the cloned KubeAid repo to the KubeAid revision.
+func checkoutKubeaidRevision(logger *slog.Logger, kubeaidRepo *git.Repository) error {
+	if kubeaidRevision == "HEAD" {
+		return nil
+	}
+
+	// Branches only exist as remote tracking branches in the clone.
+	hash, err := kubeaidRepo.ResolveRevision(plumbing.Revision(kubeaidRevision))
+	if err != nil {
+		hash, err = kubeaidRepo.ResolveRevision(plumbing.Revision("origin/" + kubeaidRevision))
+	}
+	if err != nil {
+		return errorf(exitCodeGit, "revision %s not found in KubeAid repo : %w", kubeaidRevision, err)
+	}
+
+	workTree, err := kubeaidRepo.Worktree()
+	if err != nil {
+		return errorf(exitCodeGit, "failed getting KubeAid repo worktree : %w", err)
+	}
+	if err = workTree.Checkout(&git.CheckoutOptions{Hash: *hash}); err != nil {
+		return errorf(exitCodeGit, "failed checking out KubeAid repo to %s : %w", kubeaidRevision, err)
+	}
+	logger.Info("✅ Checked out KubeAid repo", "repo", config.KubeaidRepoURL, "version", kubeaidRevision)
+	return nil
+}
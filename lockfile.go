@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Name of the lockfile, written into the cluster dir.
+const clusterLockfileName = "kubeaid.lock.yaml"
+
+type (
+	// ClusterLockfile records what was generated in the cluster dir, and from which versions.
+	ClusterLockfile struct {
+		ToolVersion string `yaml:"toolVersion"`
+
+		KubeAid struct {
+			RepoURL string `yaml:"repoURL"`
+			// Empty in dry-run mode, since the KubeAid repo isn't accessed.
+			Commit string `yaml:"commit,omitempty"`
+		} `yaml:"kubeaid"`
+
+		Templates struct {
+			// Whether the default templates were overlaid with the ones in --templates-dir.
+			Overlaid bool   `yaml:"overlaid,omitempty"`
+			Hash     string `yaml:"hash"`
+		} `yaml:"templates"`
+
+		// Hash of the config, excluding secrets.
+		ConfigHash string `yaml:"configHash"`
+
+		KubePrometheusVersion string      `yaml:"kubePrometheusVersion,omitempty"`
+		ArgocdApps            []ArgocdApp `yaml:"argocdApps"`
+
+		// Content hashes of the generated files, keyed by their path relative to the cluster dir.
+		Files map[string]string `yaml:"files"`
+	}
+)
+
+// writeClusterLockfile writes the lockfile into the cluster dir, recording the generated files in
+// it.
+func writeClusterLockfile(logger *slog.Logger, clusterDir, kubeaidCommit string) error {
+	configHash, err := getConfigHash()
+	if err != nil {
+		return err
+	}
+
+	lockfile := ClusterLockfile{
+		ToolVersion:           getVersion(),
+		ConfigHash:            configHash,
+		KubePrometheusVersion: config.KubePrometheusVersion,
+		ArgocdApps:            getArgocdApps(),
+	}
+	lockfile.KubeAid.RepoURL = config.KubeaidRepoURL
+	lockfile.KubeAid.Commit = kubeaidCommit
+	_, lockfile.Templates.Overlaid = templatesFS.(*OverlayFS)
+
+	templatesHash, err := hashFS(templatesFS)
+	if err != nil {
+		return fmt.Errorf("failed hashing templates : %w", err)
+	}
+	lockfile.Templates.Hash = templatesHash
+
+	lockfile.Files, err = hashClusterDirFiles(clusterDir)
+	if err != nil {
+		return fmt.Errorf("failed hashing files in %s : %w", clusterDir, err)
+	}
+
+	lockfileContents, err := marshalYAML(lockfile)
+	if err != nil {
+		return fmt.Errorf("failed marshalling lockfile : %w", err)
+	}
+	lockfilePath := fmt.Sprintf("%s/%s", clusterDir, clusterLockfileName)
+	if err = os.WriteFile(lockfilePath, lockfileContents, 0644); err != nil {
+		return fmt.Errorf("failed writing lockfile %s : %w", lockfilePath, err)
+	}
+	logger.Info("✅ Recorded generated files and versions in lockfile", "file", lockfilePath)
+	return nil
+}
+
+// readClusterLockfile reads the lockfile from the cluster dir. nil is returned, if it doesn't
+// exist.
+func readClusterLockfile(clusterDir string) (*ClusterLockfile, error) {
+	lockfilePath := fmt.Sprintf("%s/%s", clusterDir, clusterLockfileName)
+	lockfileContents, err := os.ReadFile(lockfilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed reading lockfile %s : %w", lockfilePath, err)
+	}
+
+	lockfile := &ClusterLockfile{}
+	if err = yaml.Unmarshal(lockfileContents, lockfile); err != nil {
+		return nil, fmt.Errorf("failed unmarshalling lockfile %s : %w", lockfilePath, err)
+	}
+	return lockfile, nil
+}
+
+// reportClusterDirDrift logs the files in the cluster dir, which have been changed or removed since
+// they were generated (as recorded in the lockfile).
+func reportClusterDirDrift(logger *slog.Logger, clusterDir string) error {
+	lockfile, err := readClusterLockfile(clusterDir)
+	if err != nil {
+		return err
+	}
+	if lockfile == nil {
+		logger.Warn(fmt.Sprintf("⚠️ %s doesn't exist, so changes made since the files were generated can't be detected", clusterLockfileName), "dir", clusterDir)
+		return nil
+	}
+	logger.Info("👀 Files were generated by an earlier run of the script", "dir", clusterDir, "version", lockfile.ToolVersion, "kubeaidCommit", lockfile.KubeAid.Commit)
+
+	fileHashes, err := hashClusterDirFiles(clusterDir)
+	if err != nil {
+		return fmt.Errorf("failed hashing files in %s : %w", clusterDir, err)
+	}
+	for filePath, generatedFileHash := range lockfile.Files {
+		fileHash, ok := fileHashes[filePath]
+		switch {
+		case !ok:
+			logger.Warn("⚠️ File has been removed since it was generated", "file", filePath)
+		case fileHash != generatedFileHash:
+			logger.Warn("⚠️ File has been changed since it was generated", "file", filePath)
+		}
+	}
+	return nil
+}
+
+// hashClusterDirFiles returns the content hashes of the files in the cluster dir (except the
+// lockfile), keyed by their path relative to the cluster dir.
+func hashClusterDirFiles(clusterDir string) (map[string]string, error) {
+	fileHashes := map[string]string{}
+	err := filepath.WalkDir(clusterDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(clusterDir, path)
+		if err != nil {
+			return err
+		}
+		if relativePath == clusterLockfileName {
+			return nil
+		}
+
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		fileHashes[filepath.ToSlash(relativePath)] = fmt.Sprintf("sha256:%x", sha256.Sum256(contents))
+		return nil
+	})
+	return fileHashes, err
+}
+
+// hashFS returns a hash of the paths and contents of all the files in the given file system.
+func hashFS(fileSystem fs.FS) (string, error) {
+	hash := sha256.New()
+	err := fs.WalkDir(fileSystem, ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		contents, err := fs.ReadFile(fileSystem, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%x\x00", path, sha256.Sum256(contents))
+		return nil
+	})
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil)), err
+}
+
+// getConfigHash returns a hash of the config. Secrets are excluded, so the hash doesn't leak
+// anything about them.
+func getConfigHash() (string, error) {
+	configWithoutSecrets := config
+	clearSecretFields(reflect.ValueOf(&configWithoutSecrets).Elem())
+
+	configContents, err := marshalYAML(configWithoutSecrets)
+	if err != nil {
+		return "", fmt.Errorf("failed marshalling config : %w", err)
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(configContents)), nil
+}
+
+func clearSecretFields(value reflect.Value) {
+	for i := 0; i < value.NumField(); i++ {
+		field, fieldValue := value.Type().Field(i), value.Field(i)
+		switch {
+		case fieldValue.Kind() == reflect.Struct:
+			clearSecretFields(fieldValue)
+		case field.Tag.Get("secret") == "true":
+			fieldValue.SetZero()
+		}
+	}
+}
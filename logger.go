@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Set using the --log-format and --log-level flags.
+var (
+	logFormat = logFormatText
+	logLevel  = new(slog.LevelVar)
+)
+
+func addLogFlags(flagSet *flag.FlagSet) {
+	flagSet.Func("log-format", "Format of the logs : text (human friendly) or json (one object per line, for e.g. to be parsed in CI pipelines) (default text)", func(value string) error {
+		if !slices.Contains([]string{logFormatText, logFormatJSON}, value) {
+			return fmt.Errorf("must be %s or %s", logFormatText, logFormatJSON)
+		}
+		logFormat = value
+		setupLogger()
+		return nil
+	})
+	flagSet.Func("log-level", "Minimum level of the logs : debug (includes the output of the commands run), info, warn or error (default info)", func(value string) error {
+		return logLevel.UnmarshalText([]byte(value))
+	})
+}
+
+// setupLogger makes slog (and the standard logger, which forwards to it) log in the chosen
+// format. Secrets resolved from the config file get redacted from the logs.
+func setupLogger() {
+	var handler slog.Handler
+	switch logFormat {
+	case logFormatJSON:
+		handler = slog.NewJSONHandler(logRedactor, &slog.HandlerOptions{
+			Level: logLevel,
+			// Secrets containing characters which get escaped in JSON wouldn't be found by
+			// logRedactor, so they're redacted before being encoded.
+			ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+				switch value := attr.Value.Any().(type) {
+				case string:
+					return slog.String(attr.Key, logRedactor.redact(value))
+				case error:
+					return slog.String(attr.Key, logRedactor.redact(value.Error()))
+				}
+				return attr
+			},
+		})
+
+	default:
+		handler = &FriendlyHandler{out: logRedactor, level: logLevel, mutex: new(sync.Mutex)}
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// FriendlyHandler formats logs for humans, the way the standard logger does : the time followed
+// by the message (which starts with an emoji, telling what kind of message it is) and its
+// attributes.
+type FriendlyHandler struct {
+	out   io.Writer
+	level slog.Leveler
+
+	mutex *sync.Mutex
+	// Prefixed to the keys of the attributes, when the handler was created using WithGroup.
+	keyPrefix string
+	// Attributes added using With (like the stage and the cluster), with their keys prefixed.
+	attrs []slog.Attr
+}
+
+func (h *FriendlyHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *FriendlyHandler) Handle(_ context.Context, record slog.Record) error {
+	var line, multilineValues strings.Builder
+	line.WriteString(record.Time.Format("2006/01/02 15:04:05 "))
+	line.WriteString(record.Message)
+
+	writeAttr := func(key string, attr slog.Attr) {
+		// Redacted before being quoted, like in JSON.
+		value := logRedactor.redact(attr.Value.Resolve().String())
+		switch {
+		// Like the output of commands, which is printed below the message.
+		case strings.Contains(value, "\n"):
+			fmt.Fprintf(&multilineValues, "%s\n", strings.TrimRight(value, "\n"))
+
+		case len(value) == 0 || strings.ContainsAny(value, " \"="):
+			fmt.Fprintf(&line, " %s=%q", key, value)
+
+		default:
+			fmt.Fprintf(&line, " %s=%s", key, value)
+		}
+	}
+	for _, attr := range h.attrs {
+		writeAttr(attr.Key, attr)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		writeAttr(h.keyPrefix+attr.Key, attr)
+		return true
+	})
+	line.WriteString("\n")
+	line.WriteString(multilineValues.String())
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	_, err := io.WriteString(h.out, line.String())
+	return err
+}
+
+func (h *FriendlyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handler := *h
+	handler.attrs = slices.Clone(h.attrs)
+	for _, attr := range attrs {
+		handler.attrs = append(handler.attrs, slog.Attr{Key: h.keyPrefix + attr.Key, Value: attr.Value})
+	}
+	return &handler
+}
+
+func (h *FriendlyHandler) WithGroup(name string) slog.Handler {
+	handler := *h
+	handler.keyPrefix += name + "."
+	return &handler
+}
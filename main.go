@@ -1,133 +1,122 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"time"
 )
 
+// Config is parsed from the YAML config file. Secret-bearing fields (tagged with secret:"true") can
+// reference environment variables (${NAME}), or be references like file:/path, exec:command or
+// env:NAME.
 type Config struct {
 	Git struct {
-		Username string `yaml:"username"`
+		Username string `yaml:"username,omitempty"`
 
-		Password        string `yaml:"password"`
-		SSHPrivateKey   string `yaml:"sshPrivateKey"`
-		UseSSHAgentAuth bool   `yaml:"useSSHAgentAuth"`
-	} `yaml:"git"`
+		Password        string `yaml:"password,omitempty" secret:"true"`
+		SSHPrivateKey   string `yaml:"sshPrivateKey,omitempty"`
+		UseSSHAgentAuth bool   `yaml:"useSSHAgentAuth,omitempty"`
+	} `yaml:"git,omitempty"`
 
-	KubeaidRepoURL       string `yaml:"kubeaidRepoURL"`
-	KubeaidConfigRepoURL string `yaml:"kubeaidConfigRepoURL"`
+	KubeaidRepoURL       string `yaml:"kubeaidRepoURL" validate:"required"`
+	KubeaidConfigRepoURL string `yaml:"kubeaidConfigRepoURL" validate:"required"`
 
-	ClusterName string `yaml:"clusterName"`
+	// Tag, commit or branch of the KubeAid repo, which the ArgoCD apps get pinned to. latest means
+	// the latest release tag. Defaults to HEAD.
+	KubeaidVersion string `yaml:"kubeaidVersion,omitempty"`
+
+	// Git platform hosting the kubeaid-config repo. When configured, the PR gets created
+	// automatically.
+	Forge struct {
+		Type   string `yaml:"type,omitempty" enum:"github,gitlab,gitea"`
+		APIURL string `yaml:"apiURL,omitempty"`
+		Token  string `yaml:"token,omitempty" secret:"true"`
+	} `yaml:"forge,omitempty"`
+
+	ClusterName string `yaml:"clusterName" validate:"required"`
 
 	ArgoCD struct {
-		RepoName      string `yaml:"repoName"`
-		RepoType      string `yaml:"repoType"`
-		RepoUsername  string `yaml:"repoUsername"`
-		RepoAuthToken string `yaml:"repoAuthToken"`
-	} `yaml:"argoCD"`
-
-	KubePrometheusVersion string `yaml:"kubePrometheusVersion"`
-	GrafanaURL            string `yaml:"grafanaURL"`
-	ConnectObmondo        bool   `yaml:"connectObmondo"`
-
-	ManagementClusterKubeconfig string `yaml:"managementClusterKubeconfig"`
-	ManagementClusterKubectx    string `yaml:"managementClusterKubectx"`
+		RepoName      string `yaml:"repoName" validate:"required"`
+		RepoType      string `yaml:"repoType" validate:"required" enum:"git,helm"`
+		RepoUsername  string `yaml:"repoUsername,omitempty"`
+		RepoAuthToken string `yaml:"repoAuthToken,omitempty" secret:"true"`
+	} `yaml:"argoCD,omitempty"`
+
+	// ArgoCD apps to be deployed, along with overrides of their default settings. Defaults to
+	// defaultArgocdApps.
+	ArgocdApps []ArgocdApp `yaml:"argocdApps,omitempty"`
+
+	KubePrometheusVersion string `yaml:"kubePrometheusVersion,omitempty"`
+	GrafanaURL            string `yaml:"grafanaURL,omitempty"`
+	ConnectObmondo        bool   `yaml:"connectObmondo,omitempty"`
+
+	// Used by the Obmondo K8s agent (deployed when connectObmondo is true), to authenticate to
+	// Obmondo.
+	Obmondo struct {
+		ClientCertFile string `yaml:"clientCertFile,omitempty"`
+		ClientKeyFile  string `yaml:"clientKeyFile,omitempty"`
+	} `yaml:"obmondo,omitempty"`
+
+	// Sealed Secrets controller running in the management cluster. Secrets are sealed using its
+	// certificate. If certFile is specified, the certificate is read from there instead of being
+	// fetched from the controller.
+	SealedSecrets struct {
+		ControllerName      string `yaml:"controllerName,omitempty"`
+		ControllerNamespace string `yaml:"controllerNamespace,omitempty"`
+		CertFile            string `yaml:"certFile,omitempty"`
+	} `yaml:"sealedSecrets,omitempty"`
+
+	ManagementClusterKubeconfig string `yaml:"managementClusterKubeconfig,omitempty"`
+	ManagementClusterKubectx    string `yaml:"managementClusterKubectx,omitempty"`
 }
 
 var (
 	currentTime = time.Now().Unix()
 
-	tempDirPath = getTempDirPath()
-	repoDir     = tempDirPath + "/kubeaid-config"
+	// Set by run.
+	tempDirPath string
+	repoDir     string
 
 	config Config
+	// Configs of the clusters listed in the config file. Commands handling multiple clusters set
+	// config to each of them in turn.
+	clusterConfigs []Config
+
+	dryRun         bool
+	prMergeTimeout time.Duration
+	resealSecrets  bool
 )
 
 func main() {
-	// Delete the temp dir after the script finishes running.
-	defer os.RemoveAll(tempDirPath)
-
-	configFile := flag.String("config-file", "", "Path to the YAML config file")
-	flag.Parse()
-
-	log.Printf("💫 Running the kubeaid cluster bootstrap script")
-
-	// Ensure CLI tools are installed.
-	ensurePrerequisitesInstalled()
-
-	// Parse CLI flags.
-	parseConfigFile(configFile)
-
-	// Detect git authentication method.
-	gitAuthMethod := getGitAuthMethod()
-
-	// Use specified kube-context.
-	log.Printf("⚙️ Setting context to %s in kubeconfig at %s", config.ManagementClusterKubectx, config.ManagementClusterKubectx)
-	kubectlConfigCmd := parseCommand(fmt.Sprintf(
-		"kubectl config use-context %s --kubeconfig %s",
-		config.ManagementClusterKubectx, config.ManagementClusterKubeconfig,
-	))
-	log.Printf("Executing command : %v", kubectlConfigCmd)
-	output, err := kubectlConfigCmd.CombinedOutput()
-	if err != nil {
-		log.Fatalf("❌ Failed setting context to %s in the kubeconfig at %s", config.ManagementClusterKubectx, config.ManagementClusterKubectx)
+	// Replaced, if a different log format is specified using --log-format.
+	setupLogger()
+
+	// Errors are returned all the way up to here, instead of exiting midway. So the script only
+	// exits after cleaning up.
+	err := run(os.Args[1:])
+	switch {
+	// The usage has already been printed.
+	case errors.Is(err, flag.ErrHelp):
+
+	case err != nil:
+		slog.Error(fmt.Sprintf("❌ %v", err))
+		os.Exit(getExitCode(err))
 	}
-	log.Println(string(output))
-
-	// Clone kubeaid-config repo.
-	repo := gitCloneRepo(config.KubeaidConfigRepoURL, repoDir, gitAuthMethod)
-	repoDefaultBranchName := getDefaultBranchName(repo)
+}
 
-	// Create and checkout to a new branch.
-	repoWorktree, err := repo.Worktree()
-	if err != nil {
-		log.Fatal("❌ Failed getting kubeaid-config repo worktree")
-	}
-	branch := fmt.Sprintf("kubeaid-%s-%d", config.ClusterName, currentTime)
-	createAndCheckoutToBranch(repo, branch, repoWorktree)
-
-	// In the k8s dir, we will create a folder for the cluster. Files related to the cluster, will
-	// be generated in this folder.
-	clusterDir := fmt.Sprintf("%s/k8s/%s", repoDir, config.ClusterName)
-	if _, err := os.Stat(clusterDir); os.IsNotExist(err) {
-		log.Fatalf("❌ Cluster dir %s already exists", clusterDir)
-	} else if err != nil {
-		log.Fatalf("Failed determining whether cluster-dir exists or not : %v", err)
+// run runs the command, inside a temp dir. The temp dir (containing the cloned repos) gets deleted
+// after the command finishes running, even if it failed.
+func run(args []string) error {
+	var err error
+	if tempDirPath, err = createTempDir(); err != nil {
+		return err
 	}
+	defer os.RemoveAll(tempDirPath)
 
-	// Generate files for ArgoCD apps and build kube-prometheus.
-	createArgoCDRelatedFiles(clusterDir, repoDefaultBranchName, gitAuthMethod)
-
-	// ArgoCD needs credentials to watch the kubeaid-config repo. These credentials will be stored in
-	// a Sealed Secret.
-	// Let's create that Sealed Secret file.
-	createSealedSecretsRelatedFiles(clusterDir)
-
-	// Add, commit and push the changes.
-	commitHash := gitAddCommitAndPushChanges(repo, repoWorktree, branch, gitAuthMethod)
-
-	// The user now needs to go ahead and create a PR from the new to the default branch. Then he
-	// needs to merge that branch.
-	// We can't create the PR for the user, since PRs are not part of the core git lib. They are
-	// specific to the git platform the user is on.
-
-	// Wait until the PR gets merged.
-	waitUntilPRMerged(repo, repoDefaultBranchName, commitHash, gitAuthMethod, branch)
-
-	// kubectl apply the root ArgoCD app.
-	// NOTE: not using client-go lib on purpose, since we only need to kubectl apply 1 file.
-	rootArgocdAppFilePath := fmt.Sprintf("%s/argocd-apps/templates/root.yaml", clusterDir)
-	kubectlApplyCmd := parseCommand(fmt.Sprintf(
-		"kubectl apply -f %s --kubeconfig %s", rootArgocdAppFilePath, config.ManagementClusterKubeconfig))
-	log.Printf("Executing command : %v", kubectlApplyCmd)
-	output, err = kubectlApplyCmd.CombinedOutput()
-	if err != nil {
-		log.Fatalf("❌ Failed kubectl applying the root ArgoCD app : %v", err)
-	}
-	log.Print(string(output))
+	repoDir = tempDirPath + "/kubeaid-config"
 
-	log.Printf("💫 Finished running the kubeaid cluster bootstrap script")
+	return runCommand(args)
 }
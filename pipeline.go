@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// BootstrapState gets persisted in the state file, after each stage of the bootstrap pipeline
+	// finishes. It's used to resume the pipeline from the last finished stage.
+	BootstrapState struct {
+		ClusterName    string `yaml:"clusterName"`
+		CompletedStage string `yaml:"completedStage"`
+		Branch         string `yaml:"branch,omitempty"`
+		CommitHash     string `yaml:"commitHash,omitempty"`
+
+		PullRequestNumber int    `yaml:"pullRequestNumber,omitempty"`
+		PullRequestURL    string `yaml:"pullRequestURL,omitempty"`
+	}
+
+	// BootstrapContext holds the in-memory handles shared between the stages of a pipeline.
+	BootstrapContext struct {
+		pipeline *Pipeline
+		state    *BootstrapState
+
+		clusters []*ClusterContext
+		// The cluster a per-cluster stage is currently running for.
+		cluster *ClusterContext
+
+		gitAuthMethod         transport.AuthMethod
+		gitForge              GitForge
+		repo                  *git.Repository
+		repoWorktree          *git.Worktree
+		repoDefaultBranchName string
+
+		// Set by a stage, when there's nothing left for the stages after it to do.
+		finished bool
+
+		// Carries the pipeline, the stage being run and (in per-cluster stages) the cluster, in the
+		// logs.
+		logger *slog.Logger
+	}
+
+	// ClusterContext holds the in-memory handles specific to one of the clusters, a pipeline runs
+	// for.
+	ClusterContext struct {
+		config          Config
+		kubeaidRevision string
+
+		kubeClient *KubeClient
+		clusterDir string
+	}
+
+	Stage struct {
+		name string
+
+		// A durable stage's outcome outlives the script (for e.g. a git push). When resuming, the
+		// pipeline continues after the last finished durable stage.
+		durable bool
+		// A setup stage only prepares in-memory handles required by the stages after it. When
+		// resuming, setup stages are always re-run.
+		setup bool
+		// A per-cluster stage runs once for each cluster, with config set to the cluster's config.
+		perCluster bool
+
+		run func(ctx *BootstrapContext) error
+	}
+
+	// Pipeline is a sequence of stages, making changes to the clusters' dirs in the kubeaid-config
+	// repo (through a single PR) and to the clusters.
+	Pipeline struct {
+		name string
+
+		// Used in the branch name.
+		branchPrefix string
+		// Used in the commit message and the PR title.
+		description string
+		// Whether the PR description shows the changes made to the cluster dirs.
+		diffInPullRequest bool
+
+		stages []Stage
+	}
+)
+
+var (
+	bootstrapPipeline = &Pipeline{
+		name:         "bootstrap",
+		branchPrefix: "kubeaid",
+		description:  "bootstrap setup",
+		stages: []Stage{
+			{name: "connect-to-cluster", setup: true, perCluster: true, run: connectToCluster},
+			{name: "clone-repo", setup: true, run: cloneKubeaidConfigRepo},
+			{name: "create-branch", setup: true, run: createBranch},
+			{name: "generate-files", perCluster: true, run: generateFiles},
+			{name: "seal-secrets", perCluster: true, run: sealSecrets},
+			{name: "write-lockfile", perCluster: true, run: writeLockfile},
+			{name: "commit-and-push", durable: true, run: commitAndPush},
+			{name: "open-pull-request", durable: true, run: openPullRequest},
+			{name: "wait-for-merge", durable: true, run: waitForMerge},
+			{name: "apply-root-app", durable: true, perCluster: true, run: applyRootArgocdApp},
+		},
+	}
+
+	// ArgoCD syncs the changes, once the PR gets merged.
+	upgradePipeline = &Pipeline{
+		name:              "upgrade",
+		branchPrefix:      "kubeaid-upgrade",
+		description:       "upgrade",
+		diffInPullRequest: true,
+		stages: []Stage{
+			{name: "connect-to-cluster", setup: true, perCluster: true, run: connectToCluster},
+			{name: "clone-repo", setup: true, run: cloneKubeaidConfigRepo},
+			{name: "create-branch", setup: true, run: createBranch},
+			{name: "regenerate-files", perCluster: true, run: regenerateFiles},
+			{name: "seal-secrets", perCluster: true, run: sealSecrets},
+			{name: "write-lockfile", perCluster: true, run: writeLockfile},
+			{name: "commit-and-push", durable: true, run: commitAndPush},
+			{name: "open-pull-request", durable: true, run: openPullRequest},
+		},
+	}
+
+	// Deleting the root ArgoCD app cascades to the other ArgoCD apps (and the resources deployed by
+	// them), since they have the resources finalizer.
+	destroyPipeline = &Pipeline{
+		name:         "destroy",
+		branchPrefix: "kubeaid-destroy",
+		description:  "teardown",
+		stages: []Stage{
+			{name: "connect-to-cluster", setup: true, perCluster: true, run: connectToCluster},
+			{name: "clone-repo", setup: true, run: cloneKubeaidConfigRepo},
+			{name: "create-branch", setup: true, run: createBranch},
+			{name: "delete-root-app", durable: true, perCluster: true, run: deleteRootArgocdApp},
+			{name: "remove-files", perCluster: true, run: removeFiles},
+			{name: "commit-and-push", durable: true, run: commitAndPush},
+			{name: "open-pull-request", durable: true, run: openPullRequest},
+		},
+	}
+)
+
+func runPipeline(pipeline *Pipeline, stateFilePath string, resume bool) error {
+	if len(stateFilePath) == 0 {
+		var err error
+		if stateFilePath, err = getDefaultStateFilePath(pipeline); err != nil {
+			return err
+		}
+	}
+
+	logger := slog.Default().With("pipeline", pipeline.name)
+
+	state, err := loadBootstrapState(logger, stateFilePath, resume)
+	if err != nil {
+		return err
+	}
+	gitForge, err := getGitForge()
+	if err != nil {
+		return err
+	}
+	ctx := &BootstrapContext{
+		pipeline: pipeline,
+		state:    state,
+		gitForge: gitForge,
+		logger:   logger,
+	}
+	for _, clusterConfig := range clusterConfigs {
+		ctx.clusters = append(ctx.clusters, &ClusterContext{
+			config:          clusterConfig,
+			kubeaidRevision: "HEAD",
+
+			// In the k8s dir, we will create a folder for the cluster. Files related to the cluster,
+			// will be generated in this folder.
+			clusterDir: fmt.Sprintf("%s/k8s/%s", repoDir, clusterConfig.ClusterName),
+		})
+	}
+
+	resumeFrom, err := getResumeStageIndex(pipeline, state.CompletedStage)
+	if err != nil {
+		return err
+	}
+	if resumeFrom > 0 {
+		logger.Info("⏩ Resuming the pipeline after the last finished stage", "stage", pipeline.stages[resumeFrom-1].name)
+	}
+
+	for i, stage := range pipeline.stages {
+		if i < resumeFrom && !stage.setup {
+			logger.Info("⏭️ Skipping already finished stage", "stage", stage.name)
+			continue
+		}
+
+		logger.Info("▶️ Running stage", "stage", stage.name)
+		stageLogger := logger.With("stage", stage.name)
+		if stage.perCluster {
+			err = ctx.runForEachCluster(stage, stageLogger)
+		} else {
+			ctx.logger = stageLogger
+			err = stage.run(ctx)
+		}
+		// The state file is kept, so the pipeline can be resumed from here.
+		if err != nil {
+			return fmt.Errorf("stage '%s' failed : %w", stage.name, err)
+		}
+
+		state.CompletedStage = stage.name
+		if err = saveBootstrapState(stateFilePath, state); err != nil {
+			return err
+		}
+
+		if ctx.finished {
+			logger.Info("⏭️ Skipping the remaining stages, since there's nothing left to do")
+			break
+		}
+	}
+
+	// The pipeline has finished, so there is nothing left to resume.
+	if err := os.Remove(stateFilePath); err != nil {
+		logger.Warn("⚠️ Failed removing state file", "file", stateFilePath, "error", err)
+	}
+	return nil
+}
+
+// runForEachCluster runs the per-cluster stage once for each cluster. The globals specific to a
+// cluster (config and the KubeAid revision) are set to the cluster's, while the stage runs for it.
+func (ctx *BootstrapContext) runForEachCluster(stage Stage, stageLogger *slog.Logger) error {
+	for _, cluster := range ctx.clusters {
+		ctx.cluster = cluster
+		config, kubeaidRevision = cluster.config, cluster.kubeaidRevision
+		if len(ctx.clusters) > 1 {
+			stageLogger.Info("▶️ Running stage for cluster", "cluster", config.ClusterName)
+		}
+
+		ctx.logger = stageLogger.With("cluster", config.ClusterName)
+		if err := stage.run(ctx); err != nil {
+			if len(ctx.clusters) > 1 {
+				return fmt.Errorf("cluster %s : %w", config.ClusterName, err)
+			}
+			return err
+		}
+
+		cluster.kubeaidRevision = kubeaidRevision
+	}
+	return nil
+}
+
+// getResumeStageIndex returns the index of the stage the pipeline should continue from, given
+// the name of the last completed stage. Results of non-durable stages are lost when the script
+// exits, so the pipeline continues after the last finished durable stage.
+func getResumeStageIndex(pipeline *Pipeline, completedStage string) (int, error) {
+	if len(completedStage) == 0 {
+		return 0, nil
+	}
+
+	completedStageIndex := -1
+	for i, stage := range pipeline.stages {
+		if stage.name == completedStage {
+			completedStageIndex = i
+			break
+		}
+	}
+	if completedStageIndex == -1 {
+		return 0, fmt.Errorf("unknown stage '%s' found in the state file", completedStage)
+	}
+
+	for i := completedStageIndex; i >= 0; i-- {
+		if pipeline.stages[i].durable {
+			return i + 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func getDefaultStateFilePath(pipeline *Pipeline) (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed determining home dir : %w", err)
+	}
+	clusterNames := strings.Join(getClusterNames(), "-")
+	if pipeline == bootstrapPipeline {
+		return fmt.Sprintf("%s/.kubeaid/state/%s.yaml", homeDir, clusterNames), nil
+	}
+	return fmt.Sprintf("%s/.kubeaid/state/%s-%s.yaml", homeDir, clusterNames, pipeline.name), nil
+}
+
+func loadBootstrapState(logger *slog.Logger, stateFilePath string, resume bool) (*BootstrapState, error) {
+	clusterNames := strings.Join(getClusterNames(), ",")
+
+	stateFileContents, err := os.ReadFile(stateFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		if resume {
+			logger.Warn("⚠️ State file doesn't exist. Starting from the beginning", "file", stateFilePath)
+		}
+		return &BootstrapState{ClusterName: clusterNames}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed reading state file %s : %w", stateFilePath, err)
+	}
+
+	// Starting over would create another branch and PR in the kubeaid-config repo.
+	if !resume {
+		return nil, errorf(exitCodeConfig, "state file %s from a previous run exists. Rerun with --resume, or delete it to start over", stateFilePath)
+	}
+
+	state := &BootstrapState{}
+	if err = yaml.Unmarshal(stateFileContents, state); err != nil {
+		return nil, fmt.Errorf("failed unmarshalling state file %s : %w", stateFilePath, err)
+	}
+	if state.ClusterName != clusterNames {
+		return nil, errorf(exitCodeConfig, "%w : %s belongs to cluster(s) %s, not %s", ErrStateFileMismatch, stateFilePath, state.ClusterName, clusterNames)
+	}
+	logger.Info("✅ Loaded state", "file", stateFilePath)
+	return state, nil
+}
+
+func saveBootstrapState(stateFilePath string, state *BootstrapState) error {
+	if err := os.MkdirAll(filepath.Dir(stateFilePath), os.ModePerm); err != nil {
+		return fmt.Errorf("failed creating dir for state file %s : %w", stateFilePath, err)
+	}
+
+	stateFileContents, err := marshalYAML(state)
+	if err != nil {
+		return fmt.Errorf("failed marshalling bootstrap state : %w", err)
+	}
+	if err = os.WriteFile(stateFilePath, stateFileContents, 0600); err != nil {
+		return fmt.Errorf("failed writing state file %s : %w", stateFilePath, err)
+	}
+	return nil
+}
+
+func connectToCluster(ctx *BootstrapContext) (err error) {
+	ctx.cluster.kubeClient, err = getKubeClient(ctx.logger)
+	return
+}
+
+func cloneKubeaidConfigRepo(ctx *BootstrapContext) (err error) {
+	// Detect git authentication method.
+	if ctx.gitAuthMethod, err = getGitAuthMethod(ctx.logger); err != nil {
+		return
+	}
+
+	if ctx.repo, err = gitCloneRepo(ctx.logger, config.KubeaidConfigRepoURL, repoDir, ctx.gitAuthMethod); err != nil {
+		return
+	}
+	if ctx.repoDefaultBranchName, err = getDefaultBranchName(ctx.repo); err != nil {
+		return
+	}
+
+	if ctx.repoWorktree, err = ctx.repo.Worktree(); err != nil {
+		return errorf(exitCodeGit, "failed getting kubeaid-config repo worktree : %w", err)
+	}
+	return
+}
+
+func createBranch(ctx *BootstrapContext) error {
+	// When resuming, reuse the branch created by the previous run. Otherwise we'd end up with a
+	// second branch (and PR) in the kubeaid-config repo.
+	if len(ctx.state.Branch) > 0 {
+		return checkoutToExistingBranch(ctx.logger, ctx.repo, ctx.state.Branch, ctx.repoWorktree)
+	}
+
+	branch := fmt.Sprintf("%s-%s-%d", ctx.pipeline.branchPrefix, strings.Join(getClusterNames(), "-"), currentTime)
+	if err := createAndCheckoutToBranch(ctx.logger, ctx.repo, branch, ctx.repoWorktree); err != nil {
+		return err
+	}
+	ctx.state.Branch = branch
+	return nil
+}
+
+// checkoutToExistingBranch checks out to the given branch, if it has already been pushed.
+// Otherwise, the branch is created locally.
+func checkoutToExistingBranch(logger *slog.Logger, repo *git.Repository, branch string, workTree *git.Worktree) error {
+	remoteBranchRef, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", branch), true)
+	if err != nil {
+		return createAndCheckoutToBranch(logger, repo, branch, workTree)
+	}
+
+	if err = workTree.Checkout(&git.CheckoutOptions{
+		Branch: plumbing.NewBranchReferenceName(branch),
+		Hash:   remoteBranchRef.Hash(),
+		Create: true,
+	}); err != nil {
+		return errorf(exitCodeGit, "failed checking out to branch '%s', in kubeaid-config repo : %w", branch, err)
+	}
+	logger.Info("✅ Checked out to existing branch in the kubeaid-config repo", "branch", branch)
+	return nil
+}
+
+func generateFiles(ctx *BootstrapContext) error {
+	if _, err := os.Stat(ctx.cluster.clusterDir); err == nil {
+		return errorf(exitCodeConfig, "%w : %s. Use the upgrade command instead", ErrClusterDirExists, ctx.cluster.clusterDir)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed determining whether cluster-dir exists or not : %w", err)
+	}
+
+	if err := resolveKubeaidRevision(context.Background(), ctx.logger, ctx.gitAuthMethod); err != nil {
+		return err
+	}
+
+	// Generate files for ArgoCD apps and build kube-prometheus.
+	return createArgoCDRelatedFiles(ctx.logger, ctx.cluster.clusterDir, ctx.repoDefaultBranchName, ctx.gitAuthMethod)
+}
+
+func regenerateFiles(ctx *BootstrapContext) error {
+	if err := ensureClusterDirExists(ctx.cluster.clusterDir); err != nil {
+		return err
+	}
+
+	if err := reportClusterDirDrift(ctx.logger, ctx.cluster.clusterDir); err != nil {
+		return err
+	}
+
+	if err := resolveKubeaidRevision(context.Background(), ctx.logger, ctx.gitAuthMethod); err != nil {
+		return err
+	}
+
+	return createArgoCDRelatedFiles(ctx.logger, ctx.cluster.clusterDir, ctx.repoDefaultBranchName, ctx.gitAuthMethod)
+}
+
+func ensureClusterDirExists(clusterDir string) error {
+	if _, err := os.Stat(clusterDir); os.IsNotExist(err) {
+		return errorf(exitCodeConfig, "%w : %s. Use the bootstrap command instead", ErrClusterDirNotFound, clusterDir)
+	} else if err != nil {
+		return fmt.Errorf("failed determining whether cluster-dir exists or not : %w", err)
+	}
+	return nil
+}
+
+func sealSecrets(ctx *BootstrapContext) error {
+	// ArgoCD needs credentials to watch the kubeaid-config repo. These credentials will be stored in
+	// a Sealed Secret.
+	// Let's create that Sealed Secret file.
+	sealedSecretsPublicKey, err := getSealedSecretsPublicKey(context.Background(), ctx.logger, ctx.cluster.kubeClient)
+	if err != nil {
+		return err
+	}
+	return createSealedSecretsRelatedFiles(ctx.logger, ctx.cluster.clusterDir, sealedSecretsPublicKey)
+}
+
+func writeLockfile(ctx *BootstrapContext) error {
+	kubeaidCommit, err := getKubeaidCommit(context.Background(), ctx.gitAuthMethod)
+	if err != nil {
+		return err
+	}
+	return writeClusterLockfile(ctx.logger, ctx.cluster.clusterDir, kubeaidCommit)
+}
+
+func commitAndPush(ctx *BootstrapContext) error {
+	clusterNames := strings.Join(getClusterNames(), ", ")
+	commitMessage := fmt.Sprintf("KubeAid %s for argo-cd applications on %s\n", ctx.pipeline.description, clusterNames)
+	commitHash, err := gitAddCommitAndPushChanges(ctx.logger, ctx.repo, ctx.repoWorktree, ctx.state.Branch, commitMessage, ctx.gitAuthMethod)
+	if err != nil {
+		return err
+	}
+	if commitHash.IsZero() {
+		ctx.logger.Info("✅ Already up to date", "clusters", clusterNames)
+		ctx.finished = true
+		return nil
+	}
+	ctx.state.CommitHash = commitHash.String()
+	return nil
+}
+
+func openPullRequest(ctx *BootstrapContext) error {
+	// PRs are not part of the core git lib. They are specific to the git platform the user is on.
+	// If the user hasn't told us which one that is, they need to go ahead and create a PR from the
+	// new to the default branch.
+	if ctx.gitForge == nil {
+		ctx.logger.Info(fmt.Sprintf("🙏 Please create a PR from branch '%s' to the default branch '%s' in the kubeaid-config repo, and merge it", ctx.state.Branch, ctx.repoDefaultBranchName), "branch", ctx.state.Branch)
+		return nil
+	}
+
+	clusterNames := strings.Join(getClusterNames(), ", ")
+	description := fmt.Sprintf("Generated by the KubeAid cluster bootstrap script, for argo-cd applications on %s.", clusterNames)
+	if ctx.pipeline.diffInPullRequest {
+		diff, err := getCommitDiff(ctx.repo, plumbing.NewHash(ctx.state.CommitHash))
+		if err != nil {
+			return errorf(exitCodeGit, "failed getting the changes made by commit %s : %w", ctx.state.CommitHash, err)
+		}
+		description += "\n\n" + diff
+	}
+
+	pullRequest, err := ctx.gitForge.CreatePullRequest(context.Background(), PullRequestOptions{
+		SourceBranch: ctx.state.Branch,
+		TargetBranch: ctx.repoDefaultBranchName,
+		Title:        fmt.Sprintf("KubeAid %s for %s", ctx.pipeline.description, clusterNames),
+		Description:  description,
+	})
+	if err != nil {
+		return errorf(exitCodeGit, "failed creating PR from branch '%s' to '%s' : %w", ctx.state.Branch, ctx.repoDefaultBranchName, err)
+	}
+	ctx.state.PullRequestNumber = pullRequest.Number
+	ctx.state.PullRequestURL = pullRequest.URL
+	ctx.logger.Info("✅ Created PR. Please get it merged", "url", pullRequest.URL)
+	return nil
+}
+
+func waitForMerge(ctx *BootstrapContext) error {
+	// Let the user stop waiting with Ctrl-C. The pipeline can then be resumed later.
+	signalCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// Wait until the PR gets merged.
+	err := waitUntilPRMerged(signalCtx, ctx.logger, ctx.repo, ctx.repoDefaultBranchName, plumbing.NewHash(ctx.state.CommitHash), ctx.gitAuthMethod, ctx.state.Branch,
+		ctx.gitForge, ctx.state.PullRequestNumber, prMergeTimeout)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return errorf(exitCodeGit, "%w : stopped waiting for branch '%s' to be merged : %w. Rerun with --resume to continue waiting", ErrPullRequestNotMerged, ctx.state.Branch, err)
+	}
+	return err
+}
+
+func applyRootArgocdApp(ctx *BootstrapContext) error {
+	rootArgocdAppFilePath := fmt.Sprintf("%s/argocd-apps/templates/root.yaml", ctx.cluster.clusterDir)
+	if err := ctx.cluster.kubeClient.applyManifestFile(context.Background(), rootArgocdAppFilePath); err != nil {
+		return errorf(exitCodeCluster, "failed applying the root ArgoCD app of cluster %s : %w", config.ClusterName, err)
+	}
+	ctx.logger.Info("✅ Applied the root ArgoCD app", "cluster", config.ClusterName)
+	return nil
+}
+
+func deleteRootArgocdApp(ctx *BootstrapContext) error {
+	if err := ctx.cluster.kubeClient.deleteArgocdApp(context.Background(), ctx.logger, "root"); err != nil {
+		return errorf(exitCodeCluster, "failed deleting the root ArgoCD app of cluster %s : %w", config.ClusterName, err)
+	}
+	ctx.logger.Info("✅ Deleted the root ArgoCD app", "cluster", config.ClusterName)
+	return nil
+}
+
+func removeFiles(ctx *BootstrapContext) error {
+	if err := ensureClusterDirExists(ctx.cluster.clusterDir); err != nil {
+		return err
+	}
+
+	clusterDirRelativePath := fmt.Sprintf("k8s/%s", config.ClusterName)
+	if _, err := ctx.repoWorktree.Remove(clusterDirRelativePath); err != nil {
+		return errorf(exitCodeGit, "failed removing %s from the kubeaid-config repo : %w", clusterDirRelativePath, err)
+	}
+	ctx.logger.Info("✅ Removed the cluster dir from the kubeaid-config repo", "dir", clusterDirRelativePath)
+	return nil
+}
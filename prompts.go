@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+
+	"github.com/charmbracelet/huh"
+	"golang.org/x/term"
+)
+
+// Set using the --non-interactive and --yes flags.
+var (
+	nonInteractive bool
+	assumeYes      bool
+)
+
+func addPromptFlags(flagSet *flag.FlagSet) {
+	flagSet.BoolVar(&nonInteractive, "non-interactive", false, "Never prompt, failing instead (unless --yes is specified). Prompts are disabled automatically, when not running in a terminal")
+	flagSet.BoolVar(&assumeYes, "yes", false, "Answer yes to all the prompts (for e.g. to install missing prerequisites)")
+}
+
+// isInteractive returns whether the user can be prompted : prompts haven't been disabled, and the
+// script is running in a terminal (unlike in CI pipelines).
+func isInteractive() bool {
+	return !nonInteractive && term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// confirm asks the user the given yes / no question. If the user can't be prompted, the answer is
+// yes only if --yes is specified.
+func confirm(question string) bool {
+	if assumeYes {
+		slog.Info("✅ " + question + " Yes, since --yes is specified")
+		return true
+	}
+	if !isInteractive() {
+		slog.Info("⏭️ " + question + " No, since prompts are disabled. Rerun with --yes to answer yes")
+		return false
+	}
+
+	var confirmed bool
+	if err := huh.NewConfirm().Title(question).Value(&confirmed).Run(); err != nil {
+		return false
+	}
+	return confirmed
+}
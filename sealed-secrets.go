@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultSealedSecretsControllerName      = "sealed-secrets"
+	defaultSealedSecretsControllerNamespace = "kube-system"
+
+	redactedPlaceholder = "<redacted>"
+
+	// Size (in bytes) of the AES-256 session key used by the Sealed Secrets hybrid encryption scheme.
+	sealedSecretsSessionKeySize = 32
+)
+
+type (
+	// KubernetesSecret is the subset of a Kubernetes Secret, relevant for sealing it.
+	KubernetesSecret struct {
+		APIVersion string            `yaml:"apiVersion"`
+		Kind       string            `yaml:"kind"`
+		Metadata   ObjectMeta        `yaml:"metadata"`
+		Type       string            `yaml:"type,omitempty"`
+		Data       map[string]string `yaml:"data,omitempty"`
+		StringData map[string]string `yaml:"stringData,omitempty"`
+	}
+
+	SealedSecret struct {
+		APIVersion string           `yaml:"apiVersion"`
+		Kind       string           `yaml:"kind"`
+		Metadata   ObjectMeta       `yaml:"metadata"`
+		Spec       SealedSecretSpec `yaml:"spec"`
+	}
+
+	SealedSecretSpec struct {
+		EncryptedData map[string]string    `yaml:"encryptedData"`
+		Template      SealedSecretTemplate `yaml:"template"`
+	}
+
+	// SealedSecretTemplate is used by the Sealed Secrets controller, to create the Kubernetes
+	// Secret.
+	SealedSecretTemplate struct {
+		Metadata ObjectMeta `yaml:"metadata"`
+		Type     string     `yaml:"type,omitempty"`
+	}
+
+	ObjectMeta struct {
+		Name        string            `yaml:"name"`
+		Namespace   string            `yaml:"namespace"`
+		Labels      map[string]string `yaml:"labels,omitempty"`
+		Annotations map[string]string `yaml:"annotations,omitempty"`
+	}
+)
+
+// getSealedSecretsPublicKey returns the public key used for sealing secrets. It's read from the
+// configured certificate file, or else fetched from the Sealed Secrets controller.
+func getSealedSecretsPublicKey(ctx context.Context, logger *slog.Logger, kubeClient *KubeClient) (*rsa.PublicKey, error) {
+	var (
+		certPEM []byte
+		err     error
+	)
+	if len(config.SealedSecrets.CertFile) > 0 {
+		certPEM, err = os.ReadFile(config.SealedSecrets.CertFile)
+		if err != nil {
+			return nil, errorf(exitCodeConfig, "failed reading Sealed Secrets certificate file %s : %w", config.SealedSecrets.CertFile, err)
+		}
+		logger.Info("🔑 Using Sealed Secrets certificate from file", "file", config.SealedSecrets.CertFile)
+	} else {
+		controllerName, controllerNamespace := getSealedSecretsController()
+		certPEM, err = kubeClient.clientset.CoreV1().Services(controllerNamespace).
+			ProxyGet("http", controllerName, "", "/v1/cert.pem", nil).
+			DoRaw(ctx)
+		if err != nil {
+			return nil, errorf(exitCodeCluster, "failed fetching certificate from Sealed Secrets controller %s/%s : %w", controllerNamespace, controllerName, err)
+		}
+		logger.Info("🔑 Fetched certificate from Sealed Secrets controller", "controller", controllerNamespace+"/"+controllerName)
+	}
+
+	publicKey, err := parseSealedSecretsCertificate(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing Sealed Secrets certificate : %w", err)
+	}
+	return publicKey, nil
+}
+
+func getSealedSecretsController() (name, namespace string) {
+	name, namespace = config.SealedSecrets.ControllerName, config.SealedSecrets.ControllerNamespace
+	if len(name) == 0 {
+		name = defaultSealedSecretsControllerName
+	}
+	if len(namespace) == 0 {
+		namespace = defaultSealedSecretsControllerNamespace
+	}
+	return
+}
+
+func parseSealedSecretsCertificate(certPEM []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM encoded certificate found")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected RSA public key, found %T", cert.PublicKey)
+	}
+	return publicKey, nil
+}
+
+// sealSecret converts the given Kubernetes Secret manifest to a strict scoped Sealed Secret
+// manifest, like kubeseal does. Only the Sealed Secrets controller (having the private key) can
+// decrypt it.
+func sealSecret(secretManifest []byte, publicKey *rsa.PublicKey) ([]byte, error) {
+	secret := KubernetesSecret{}
+	if err := yaml.Unmarshal(secretManifest, &secret); err != nil {
+		return nil, fmt.Errorf("failed unmarshalling secret : %w", err)
+	}
+	if secret.Kind != "Secret" {
+		return nil, fmt.Errorf("expected kind Secret, found %s", secret.Kind)
+	}
+	if len(secret.Metadata.Name) == 0 || len(secret.Metadata.Namespace) == 0 {
+		return nil, fmt.Errorf("secret name and namespace must be specified")
+	}
+
+	plaintextData := map[string][]byte{}
+	for key, value := range secret.Data {
+		decodedValue, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed base64 decoding value of key %s : %w", key, err)
+		}
+		plaintextData[key] = decodedValue
+	}
+	for key, value := range secret.StringData {
+		plaintextData[key] = []byte(value)
+	}
+
+	// With strict scope, the Sealed Secret can only be decrypted with the same name and namespace.
+	label := []byte(fmt.Sprintf("%s/%s", secret.Metadata.Namespace, secret.Metadata.Name))
+
+	encryptedData := map[string]string{}
+	for key, value := range plaintextData {
+		ciphertext, err := hybridEncrypt(rand.Reader, publicKey, value, label)
+		if err != nil {
+			return nil, fmt.Errorf("failed encrypting value of key %s : %w", key, err)
+		}
+		encryptedData[key] = base64.StdEncoding.EncodeToString(ciphertext)
+	}
+
+	return marshalYAML(SealedSecret{
+		APIVersion: "bitnami.com/v1alpha1",
+		Kind:       "SealedSecret",
+		Metadata: ObjectMeta{
+			Name:      secret.Metadata.Name,
+			Namespace: secret.Metadata.Namespace,
+		},
+		Spec: SealedSecretSpec{
+			EncryptedData: encryptedData,
+			Template: SealedSecretTemplate{
+				Metadata: secret.Metadata,
+				Type:     secret.Type,
+			},
+		},
+	})
+}
+
+// redactSecret replaces the values in the given Kubernetes Secret manifest with a placeholder, so
+// it can be shown / written without leaking the secret values.
+func redactSecret(secretManifest []byte) ([]byte, error) {
+	secret := KubernetesSecret{}
+	if err := yaml.Unmarshal(secretManifest, &secret); err != nil {
+		return nil, fmt.Errorf("failed unmarshalling secret : %w", err)
+	}
+
+	for key := range secret.Data {
+		secret.Data[key] = redactedPlaceholder
+	}
+	for key := range secret.StringData {
+		secret.StringData[key] = redactedPlaceholder
+	}
+
+	return marshalYAML(secret)
+}
+
+// hybridEncrypt implements the encryption scheme used by Sealed Secrets : the plaintext is
+// encrypted using AES-256-GCM with a random session key, which in turn is encrypted using
+// RSA-OAEP. The output is the 2 byte (big endian) length of the encrypted session key, followed by
+// the encrypted session key and the AES-GCM ciphertext.
+func hybridEncrypt(random io.Reader, publicKey *rsa.PublicKey, plaintext, label []byte) ([]byte, error) {
+	sessionKey := make([]byte, sealedSecretsSessionKeySize)
+	if _, err := io.ReadFull(random, sessionKey); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedSessionKey, err := rsa.EncryptOAEP(sha256.New(), random, publicKey, sessionKey, label)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := make([]byte, 2)
+	binary.BigEndian.PutUint16(ciphertext, uint16(len(encryptedSessionKey)))
+	ciphertext = append(ciphertext, encryptedSessionKey...)
+
+	// The session key is used only once, so a zero nonce is safe.
+	zeroNonce := make([]byte, aead.NonceSize())
+	return aead.Seal(ciphertext, zeroNonce, plaintext, nil), nil
+}
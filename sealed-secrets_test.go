@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const testSecretManifest = `apiVersion: v1
+kind: Secret
+metadata:
+  name: kubeaid-config
+  namespace: argo-cd
+type: Opaque
+data:
+  username: YWRtaW4=
+stringData:
+  password: "p@ss: #word\n"
+`
+
+// hybridDecrypt reverses hybridEncrypt, the way the Sealed Secrets controller does.
+func hybridDecrypt(privateKey *rsa.PrivateKey, ciphertext, label []byte) ([]byte, error) {
+	if len(ciphertext) < 2 {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	encryptedSessionKeyLength := int(binary.BigEndian.Uint16(ciphertext))
+	if len(ciphertext) < 2+encryptedSessionKeyLength {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	encryptedSessionKey, ciphertext := ciphertext[2:2+encryptedSessionKeyLength], ciphertext[2+encryptedSessionKeyLength:]
+
+	sessionKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, encryptedSessionKey, label)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext, nil)
+}
+
+func TestSealSecret(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealedSecretManifest, err := sealSecret([]byte(testSecretManifest), &privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedSecret := SealedSecret{}
+	if err = yaml.Unmarshal(sealedSecretManifest, &sealedSecret); err != nil {
+		t.Fatal(err)
+	}
+
+	if sealedSecret.Kind != "SealedSecret" || sealedSecret.Metadata.Name != "kubeaid-config" || sealedSecret.Metadata.Namespace != "argo-cd" {
+		t.Errorf("unexpected sealed secret metadata : %+v", sealedSecret.Metadata)
+	}
+	if sealedSecret.Spec.Template.Type != "Opaque" {
+		t.Errorf("expected template type Opaque, found %s", sealedSecret.Spec.Template.Type)
+	}
+
+	expectedData := map[string]string{
+		"username": "admin",
+		"password": "p@ss: #word\n",
+	}
+	if len(sealedSecret.Spec.EncryptedData) != len(expectedData) {
+		t.Fatalf("expected %d encrypted values, found %d", len(expectedData), len(sealedSecret.Spec.EncryptedData))
+	}
+	for key, expectedValue := range expectedData {
+		ciphertext, err := base64.StdEncoding.DecodeString(sealedSecret.Spec.EncryptedData[key])
+		if err != nil {
+			t.Fatalf("failed base64 decoding value of key %s : %v", key, err)
+		}
+
+		value, err := hybridDecrypt(privateKey, ciphertext, []byte("argo-cd/kubeaid-config"))
+		if err != nil {
+			t.Fatalf("failed decrypting value of key %s : %v", key, err)
+		}
+		if string(value) != expectedValue {
+			t.Errorf("expected value %q of key %s, found %q", expectedValue, key, value)
+		}
+
+		// Strict scope : the value can't be decrypted, if the Sealed Secret gets renamed or moved to
+		// another namespace.
+		for _, label := range []string{"default/kubeaid-config", "argo-cd/other"} {
+			if _, err := hybridDecrypt(privateKey, ciphertext, []byte(label)); err == nil {
+				t.Errorf("value of key %s got decrypted with label %s", key, label)
+			}
+		}
+	}
+}
+
+func TestSealSecretRejectsInvalidSecrets(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]string{
+		"wrong kind":        "kind: ConfigMap\nmetadata:\n  name: a\n  namespace: b\n",
+		"missing name":      "kind: Secret\nmetadata:\n  namespace: b\n",
+		"missing namespace": "kind: Secret\nmetadata:\n  name: a\n",
+		"invalid base64":    "kind: Secret\nmetadata:\n  name: a\n  namespace: b\ndata:\n  key: '!'\n",
+	}
+	for name, secretManifest := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := sealSecret([]byte(secretManifest), &privateKey.PublicKey); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
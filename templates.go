@@ -0,0 +1,143 @@
+package main
+
+import (
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// Default templates, embedded into the binary.
+//
+//go:embed k8s/cluster
+var embeddedTemplates embed.FS
+
+// templatesFS contains the templates used to generate files for a cluster. Paths are relative to
+// the k8s/cluster dir.
+var templatesFS fs.FS
+
+// getTemplatesFS returns the embedded templates, overlaid with the templates in the given dir (if
+// specified). Files in the overlay dir replace or add to the embedded ones.
+func getTemplatesFS(overlayDir string) (fs.FS, error) {
+	defaultTemplatesFS, err := fs.Sub(embeddedTemplates, "k8s/cluster")
+	if err != nil {
+		return nil, fmt.Errorf("failed reading embedded templates : %w", err)
+	}
+
+	if len(overlayDir) == 0 {
+		return defaultTemplatesFS, nil
+	}
+
+	if _, err := os.Stat(overlayDir); err != nil {
+		return nil, errorf(exitCodeConfig, "failed reading templates dir %s : %w", overlayDir, err)
+	}
+	slog.Info("📁 Using templates on top of the default ones", "dir", overlayDir)
+
+	return &OverlayFS{
+		overlay: os.DirFS(overlayDir),
+		base:    defaultTemplatesFS,
+	}, nil
+}
+
+// Helper functions available in templates.
+var templateFuncs = template.FuncMap{
+	// quote returns the value as a double quoted string, with special characters escaped. The result
+	// is valid in both YAML and jsonnet.
+	"quote": func(value any) (string, error) {
+		quotedValue := &strings.Builder{}
+
+		encoder := json.NewEncoder(quotedValue)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(fmt.Sprint(value)); err != nil {
+			return "", err
+		}
+
+		return strings.TrimSuffix(quotedValue.String(), "\n"), nil
+	},
+
+	"b64enc": func(value string) string {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	},
+
+	// indent prefixes each line of the value with the given number of spaces.
+	"indent": func(spaces int, value string) string {
+		padding := strings.Repeat(" ", spaces)
+		return padding + strings.ReplaceAll(value, "\n", "\n"+padding)
+	},
+
+	"toYaml": func(value any) (string, error) {
+		yamlValue, err := marshalYAML(value)
+		return strings.TrimSuffix(string(yamlValue), "\n"), err
+	},
+
+	// required fails the template execution with the given message, if the value is empty.
+	"required": func(message string, value any) (any, error) {
+		if value == nil || reflect.ValueOf(value).IsZero() {
+			return nil, errors.New(message)
+		}
+		return value, nil
+	},
+}
+
+// parseTemplates parses the templates matching the given patterns from templatesFS. The returned
+// template is named after the first pattern's base name. Referencing missing keys is an error.
+func parseTemplates(patterns ...string) (*template.Template, error) {
+	return template.New(path.Base(patterns[0])).
+		Funcs(templateFuncs).
+		Option("missingkey=error").
+		ParseFS(templatesFS, patterns...)
+}
+
+// OverlayFS is a read-only filesystem, where files in the overlay filesystem take precedence over
+// the ones in the base filesystem.
+type OverlayFS struct {
+	overlay,
+	base fs.FS
+}
+
+func (o *OverlayFS) Open(name string) (fs.File, error) {
+	file, err := o.overlay.Open(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return file, err
+	}
+	return o.base.Open(name)
+}
+
+// ReadDir merges the entries of the dir from both the filesystems.
+func (o *OverlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	overlayEntries, overlayErr := fs.ReadDir(o.overlay, name)
+	if overlayErr != nil && !errors.Is(overlayErr, fs.ErrNotExist) {
+		return nil, overlayErr
+	}
+
+	baseEntries, baseErr := fs.ReadDir(o.base, name)
+	if baseErr != nil && !errors.Is(baseErr, fs.ErrNotExist) {
+		return nil, baseErr
+	}
+
+	if overlayErr != nil && baseErr != nil {
+		return nil, overlayErr
+	}
+
+	entries := overlayEntries
+	for _, baseEntry := range baseEntries {
+		if !slices.ContainsFunc(overlayEntries, func(overlayEntry fs.DirEntry) bool {
+			return overlayEntry.Name() == baseEntry.Name()
+		}) {
+			entries = append(entries, baseEntry)
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
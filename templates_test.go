@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Run go test -run TestTemplates -update, to regenerate the golden files after changing the
+// templates.
+var updateGoldenFiles = flag.Bool("update", false, "Update the golden files in testdata/golden")
+
+// Values containing characters, which have a special meaning in YAML or jsonnet.
+const (
+	adversarialURL      = "https://example.com/kubeaid.git?ref=a&b=c+d#frag"
+	adversarialPassword = `p<a>ss: "w#rd" \ 'x'` + "\nline2"
+)
+
+func setupTemplatesFS(t *testing.T) {
+	t.Helper()
+
+	var err error
+	if templatesFS, err = getTemplatesFS(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func renderTemplate(t *testing.T, templatePath string, templateValues any) ([]byte, error) {
+	t.Helper()
+
+	tmpl, err := parseTemplates(templatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &bytes.Buffer{}
+	err = tmpl.Execute(output, templateValues)
+	return output.Bytes(), err
+}
+
+func assertGoldenFile(t *testing.T, goldenFileName string, output []byte) {
+	t.Helper()
+
+	goldenFilePath := filepath.Join("testdata", "golden", goldenFileName)
+	if *updateGoldenFiles {
+		if err := os.WriteFile(goldenFilePath, output, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectedOutput, err := os.ReadFile(goldenFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output, expectedOutput) {
+		t.Errorf("output doesn't match %s :\n%s", goldenFilePath, output)
+	}
+}
+
+func TestTemplatesArgocdApp(t *testing.T) {
+	setupTemplatesFS(t)
+
+	templateValues := ArgocdAppTemplateValues{
+		ArgocdApp: ArgocdApp{
+			Name:           "keda",
+			Namespace:      `ns: "quoted" #comment`,
+			ChartPath:      "argocd-helm-charts/<keda> & co",
+			TargetRevision: "v1.2.3+build",
+			SyncOptions:    []string{"CreateNamespace=true", "Key=a: b # c\nd"},
+		},
+		ClusterName:       "dev",
+		KubeAidRepo:       adversarialURL,
+		KubeAidConfigRepo: "git@github.com:obmondo/kubeaid-config.git",
+		Branch:            "feature/a&b",
+	}
+	output, err := renderTemplate(t, "argocd-app.yaml", templateValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGoldenFile(t, "argocd-app.yaml", output)
+
+	// The values must survive the round trip through YAML unchanged.
+	argocdApp := struct {
+		Metadata struct {
+			Name string `yaml:"name"`
+		} `yaml:"metadata"`
+		Spec struct {
+			Destination struct {
+				Namespace string `yaml:"namespace"`
+			} `yaml:"destination"`
+			Sources []struct {
+				RepoURL        string `yaml:"repoURL"`
+				Path           string `yaml:"path"`
+				TargetRevision string `yaml:"targetRevision"`
+			} `yaml:"sources"`
+			SyncPolicy struct {
+				SyncOptions []string `yaml:"syncOptions"`
+			} `yaml:"syncPolicy"`
+		} `yaml:"spec"`
+	}{}
+	if err = yaml.Unmarshal(output, &argocdApp); err != nil {
+		t.Fatalf("rendered ArgoCD app isn't valid YAML : %v", err)
+	}
+	if argocdApp.Spec.Destination.Namespace != templateValues.Namespace {
+		t.Errorf("expected namespace %q, found %q", templateValues.Namespace, argocdApp.Spec.Destination.Namespace)
+	}
+	if len(argocdApp.Spec.Sources) != 2 {
+		t.Fatalf("expected 2 sources, found %d", len(argocdApp.Spec.Sources))
+	}
+	if source := argocdApp.Spec.Sources[0]; source.RepoURL != adversarialURL || source.Path != templateValues.ChartPath || source.TargetRevision != templateValues.TargetRevision {
+		t.Errorf("unexpected KubeAid repo source : %+v", source)
+	}
+	if source := argocdApp.Spec.Sources[1]; source.TargetRevision != templateValues.Branch {
+		t.Errorf("expected branch %q, found %q", templateValues.Branch, source.TargetRevision)
+	}
+	if syncOptions := argocdApp.Spec.SyncPolicy.SyncOptions; len(syncOptions) != 2 || syncOptions[1] != templateValues.SyncOptions[1] {
+		t.Errorf("unexpected sync options : %q", syncOptions)
+	}
+}
+
+func TestTemplatesClusterJsonnet(t *testing.T) {
+	setupTemplatesFS(t)
+
+	output, err := renderTemplate(t, "cluster.jsonnet", JsonnetFileTemplateValues{
+		ConnectObmondo:        true,
+		KubePrometheusVersion: "v0.14.0",
+		GrafanaURL:            "https://grafana.example.com/?orgId=1&theme=dark+x#'quoted'\"",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGoldenFile(t, "cluster.jsonnet", output)
+}
+
+func TestTemplatesKubeaidConfigSecret(t *testing.T) {
+	setupTemplatesFS(t)
+
+	templateValues := SealedSecretArgocdRepoCredentialsTemplateValues{
+		Name:     "kubeaid-config",
+		Password: adversarialPassword,
+		Type:     "git",
+		URL:      adversarialURL,
+		Username: "user@example.com",
+	}
+	output, err := renderTemplate(t, "sealed-secrets/argo-cd/kubeaid-config.yaml", templateValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGoldenFile(t, "kubeaid-config.yaml", output)
+
+	secret := KubernetesSecret{}
+	if err = yaml.Unmarshal(output, &secret); err != nil {
+		t.Fatalf("rendered Kubernetes Secret isn't valid YAML : %v", err)
+	}
+	for key, expectedValue := range map[string]string{"password": adversarialPassword, "url": adversarialURL} {
+		value, err := base64.StdEncoding.DecodeString(secret.Data[key])
+		if err != nil {
+			t.Fatalf("failed base64 decoding value of key %s : %v", key, err)
+		}
+		if string(value) != expectedValue {
+			t.Errorf("expected value %q of key %s, found %q", expectedValue, key, value)
+		}
+	}
+}
+
+func TestTemplatesFailOnMissingValues(t *testing.T) {
+	setupTemplatesFS(t)
+
+	testCases := map[string]struct {
+		templatePath   string
+		templateValues any
+	}{
+		"required kubePrometheusVersion": {
+			templatePath:   "cluster.jsonnet",
+			templateValues: JsonnetFileTemplateValues{GrafanaURL: "https://grafana.example.com"},
+		},
+		"required kubeaidConfigRepoURL": {
+			templatePath:   "sealed-secrets/argo-cd/kubeaid-config.yaml",
+			templateValues: SealedSecretArgocdRepoCredentialsTemplateValues{Name: "kubeaid-config"},
+		},
+		"missing key": {
+			templatePath:   "argocd-app.yaml",
+			templateValues: map[string]any{"Name": "keda"},
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := renderTemplate(t, testCase.templatePath, testCase.templateValues); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
-	"encoding/base64"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/go-git/go-git/v5"
@@ -19,105 +25,118 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-func parseConfigFile(configFile *string) {
-	configFileContents, err := os.ReadFile(*configFile)
-	if err != nil {
-		log.Fatalf("❌ Failed reading config file : %v", err)
-	}
-	err = yaml.Unmarshal(configFileContents, &config)
-	if err != nil {
-		log.Fatalf("❌ Failed unmarshalling config file : %v", err)
-	}
-	log.Println("✅ Parsed config from the config file")
-}
-
-func getTempDirPath() string {
+func createTempDir() (string, error) {
 	name := fmt.Sprintf("kubeaid-bootstrap-script-%d", currentTime)
 	path, err := os.MkdirTemp("/tmp", name)
 	if err != nil {
-		log.Fatalf("❌ Failed creating temp dir : %v", err)
+		return "", fmt.Errorf("failed creating temp dir : %w", err)
 	}
-	log.Printf("📁 Created temp dir %s", path)
-	return path
+	slog.Debug("📁 Created temp dir", "dir", path)
+	return path, nil
 }
 
-func getGitAuthMethod() (authMethod transport.AuthMethod) {
+func getGitAuthMethod(logger *slog.Logger) (transport.AuthMethod, error) {
 	if len(config.Git.SSHPrivateKey) > 0 {
 		publicKeys, err := ssh.NewPublicKeysFromFile("git", config.Git.SSHPrivateKey, config.Git.Password)
 		if err != nil {
-			log.Fatalf("❌ Failed generating SSH public key from SSH private key and password for git : %v", err)
+			return nil, errorf(exitCodeGit, "%w : failed generating SSH public key from SSH private key and password for git : %w", ErrAuth, err)
 		}
-		authMethod = publicKeys
-		log.Println("🔑 Using SSH private key and password for git authentication")
-		return
+		logger.Info("🔑 Using SSH private key and password for git authentication")
+		return publicKeys, nil
 	}
 
 	if len(config.Git.Password) > 0 {
-		authMethod = &http.BasicAuth{
+		logger.Info("🔑 Using password for git authentication")
+		return &http.BasicAuth{
 			Username: config.Git.Username,
 			Password: config.Git.Password,
-		}
-		log.Println("🔑 Using password for git authentication")
-		return
+		}, nil
 	}
 
 	sshAuth, err := ssh.NewSSHAgentAuth("git")
 	if err != nil {
-		log.Fatalf("❌ ssh agent failed : %v", err)
+		return nil, errorf(exitCodeGit, "%w : ssh agent failed : %w", ErrAuth, err)
 	}
-	authMethod = sshAuth
-	log.Println("🔑 Using SSH agent for git authentication")
-	return
+	logger.Info("🔑 Using SSH agent for git authentication")
+	return sshAuth, nil
 }
 
-func gitCloneRepo(url, dir string, authMethod transport.AuthMethod) *git.Repository {
+// wrapGitAuthError wraps ErrAuth into errors returned by git operations, caused by the git
+// credentials being missing or rejected.
+func wrapGitAuthError(err error) error {
+	if errors.Is(err, transport.ErrAuthenticationRequired) || errors.Is(err, transport.ErrAuthorizationFailed) {
+		return fmt.Errorf("%w : %w", ErrAuth, err)
+	}
+	return err
+}
+
+func gitCloneRepo(logger *slog.Logger, url, dir string, authMethod transport.AuthMethod) (*git.Repository, error) {
 	repo, err := git.PlainClone(dir, false, &git.CloneOptions{
 		Auth: authMethod,
 		URL:  url,
 	})
 	if err != nil {
-		log.Fatalf("❌ Failed git cloning repo %s in %s : %v", url, dir, err)
+		return nil, errorf(exitCodeGit, "failed git cloning repo %s in %s : %w", url, dir, wrapGitAuthError(err))
 	}
-	log.Printf("✅ Cloned repo %s in %s", url, dir)
-	return repo
+	logger.Info("✅ Cloned repo", "repo", url, "dir", dir)
+	return repo, nil
 }
 
-func getDefaultBranchName(repo *git.Repository) string {
+func getDefaultBranchName(repo *git.Repository) (string, error) {
 	headRef, err := repo.Head()
 	if err != nil {
-		log.Fatal("❌ Failed getting HEAD ref of kubeaid-config repo")
+		return "", errorf(exitCodeGit, "failed getting HEAD ref of kubeaid-config repo : %w", err)
 	}
-	return headRef.Name().Short()
+	return headRef.Name().Short(), nil
 }
 
-func createAndCheckoutToBranch(repo *git.Repository, branch string, workTree *git.Worktree) {
+func createAndCheckoutToBranch(logger *slog.Logger, repo *git.Repository, branch string, workTree *git.Worktree) error {
 	// Check if the branch already exists.
 	branchRef, err := repo.Reference(plumbing.ReferenceName("refs/heads/"+branch), true)
 	if err == nil && branchRef != nil {
-		log.Fatalf("❌ Branch '%s' already exists in the kubeaid-config repo", branch)
+		return errorf(exitCodeGit, "%w : '%s' in the kubeaid-config repo", ErrBranchExists, branch)
 	}
 
 	if err = workTree.Checkout(&git.CheckoutOptions{
 		Branch: plumbing.ReferenceName("refs/heads/" + branch),
 		Create: true,
 	}); err != nil {
-		log.Fatalf("❌ Failed creating branch '%s', in kubeaid-config repo : %v", branch, err)
+		return errorf(exitCodeGit, "failed creating branch '%s', in kubeaid-config repo : %w", branch, err)
 	}
-	log.Printf("✅ Created branch '%s' in the kubeaid-config repo", branch)
+	logger.Info("✅ Created branch in the kubeaid-config repo", "branch", branch)
+	return nil
 }
 
-func gitAddCommitAndPushChanges(repo *git.Repository, workTree *git.Worktree, branch string, auth transport.AuthMethod) plumbing.Hash {
-	if err := workTree.AddGlob(fmt.Sprintf("k8s/%s/*", config.ClusterName)); err != nil {
-		log.Fatalf("❌ Failed adding changes to git : %v", err)
+// gitAddCommitAndPushChanges commits the changes in the cluster dirs and pushes them. If there are
+// no changes, the zero hash is returned.
+func gitAddCommitAndPushChanges(logger *slog.Logger, repo *git.Repository, workTree *git.Worktree, branch, commitMessage string, auth transport.AuthMethod) (plumbing.Hash, error) {
+	// Unlike AddGlob, Add stages files removed from the cluster dir as well. When the whole cluster
+	// dir gets removed, its removal has already been staged.
+	for _, clusterName := range getClusterNames() {
+		clusterDir := fmt.Sprintf("k8s/%s", clusterName)
+		if _, err := workTree.Filesystem.Stat(clusterDir); err == nil {
+			if _, err = workTree.Add(clusterDir); err != nil {
+				return plumbing.ZeroHash, errorf(exitCodeGit, "failed adding changes to git : %w", err)
+			}
+		}
 	}
 
 	status, err := workTree.Status()
 	if err != nil {
-		log.Fatalf("❌ Failed determining git status : %v", err)
+		return plumbing.ZeroHash, errorf(exitCodeGit, "failed determining git status : %w", err)
+	}
+	logger.Debug("git status", "output", status.String())
+
+	if status.IsClean() {
+		logger.Info("✅ Nothing has changed, so there is nothing to commit")
+		return plumbing.ZeroHash, nil
+	}
+
+	// Make sure we never push plaintext secrets.
+	if err = ensureNoPlaintextSecretsStaged(workTree, status); err != nil {
+		return plumbing.ZeroHash, errorf(exitCodeGit, "refusing to commit : %w", err)
 	}
-	log.Printf("git status : %v\n", status)
 
-	commitMessage := fmt.Sprintf("KubeAid bootstrap setup for argo-cd applications on %s\n", config.ClusterName)
 	commit, err := workTree.Commit(commitMessage, &git.CommitOptions{
 		Author: &object.Signature{
 			Name:  "KubeAid Installer",
@@ -126,55 +145,276 @@ func gitAddCommitAndPushChanges(repo *git.Repository, workTree *git.Worktree, br
 		},
 	})
 	if err != nil {
-		log.Fatalf("❌ Failed creating git commit : %v", err)
+		return plumbing.ZeroHash, errorf(exitCodeGit, "failed creating git commit : %w", err)
 	}
 	commitObject, err := repo.CommitObject(commit)
 	if err != nil {
-		log.Fatalf("❌ Failed getting commit object : %v", err)
+		return plumbing.ZeroHash, errorf(exitCodeGit, "failed getting commit object : %w", err)
 	}
-	log.Printf("git commit object : %v", commitObject)
 
+	// The progress is only logged in debug level.
+	var pushProgress bytes.Buffer
 	if err = repo.Push(&git.PushOptions{
-		Progress:   os.Stdout,
+		Progress:   &pushProgress,
 		RemoteName: "origin",
 		RefSpecs: []gitConfig.RefSpec{
 			gitConfig.RefSpec("refs/heads/" + branch + ":refs/heads/" + branch),
 		},
 		Auth: auth,
 	}); err != nil {
-		log.Fatalf("❌ git push failed : %v", err)
+		return plumbing.ZeroHash, errorf(exitCodeGit, "git push failed : %w", wrapGitAuthError(err))
+	}
+
+	logger.Debug("git push", "output", pushProgress.String())
+	logger.Info("✅ Added, committed and pushed changes", "branch", branch, "commit", commitObject.Hash.String())
+	return commitObject.Hash, nil
+}
+
+// Forges limit the length of PR descriptions (GitHub to 65536 characters).
+const maxPullRequestDiffLength = 50000
+
+// getCommitDiff returns the changes made by the given commit (compared to its parent), formatted as
+// markdown : a summary of changed files, followed by the patch. The patch gets truncated if it's
+// too long.
+func getCommitDiff(repo *git.Repository, commitHash plumbing.Hash) (string, error) {
+	commit, err := repo.CommitObject(commitHash)
+	if err != nil {
+		return "", err
+	}
+	parentCommit, err := commit.Parent(0)
+	if err != nil {
+		return "", err
+	}
+	patch, err := parentCommit.Patch(commit)
+	if err != nil {
+		return "", err
 	}
 
-	log.Printf("✅ Added, committed and pushed changes | Commit hash = %s", commitObject.Hash)
-	return commitObject.Hash
+	diff := patch.String()
+	if len(diff) > maxPullRequestDiffLength {
+		diff = diff[:maxPullRequestDiffLength] + "\n... (truncated, see the PR's changes for the full diff)\n"
+	}
+	return fmt.Sprintf("```\n%s```\n\n<details>\n<summary>Diff</summary>\n\n```diff\n%s```\n</details>\n", patch.Stats().String(), diff), nil
 }
 
-func waitUntilPRMerged(repo *git.Repository, defaultBranchName string, commitHash plumbing.Hash, auth transport.AuthMethod, branchToBeMerged string) {
+const (
+	prMergeCheckInitialInterval = 10 * time.Second
+	prMergeCheckMaxInterval     = 5 * time.Minute
+)
+
+// waitUntilPRMerged blocks until the branch gets merged into the default branch, the timeout
+// elapses (a zero timeout means waiting forever) or ctx gets cancelled. The interval between
+// consecutive checks grows exponentially. Failed checks are retried, unless the PR got closed or
+// authentication failed.
+//
+// If a forge is configured, the PR's merged state is checked. Otherwise, the branch is considered
+// merged if the commit is present in the default branch, or if k8s/<cluster> has the same
+// contents in both, for each cluster. The latter detects squash and rebase merges.
+func waitUntilPRMerged(ctx context.Context, logger *slog.Logger, repo *git.Repository, defaultBranchName string, commitHash plumbing.Hash, auth transport.AuthMethod, branchToBeMerged string, forge GitForge, prNumber int, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	interval := prMergeCheckInitialInterval
 	for {
-		log.Printf("👀 Waiting for %s branch to be merged into the default branch %s. Sleeping for 10 seconds...\n", branchToBeMerged, defaultBranchName)
-		time.Sleep(10 * time.Second)
+		logger.Info("👀 Waiting for the branch to be merged into the default branch", "branch", branchToBeMerged, "defaultBranch", defaultBranchName, "interval", interval)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		interval = min(interval*2, prMergeCheckMaxInterval)
 
-		if err := repo.Fetch(&git.FetchOptions{
-			Auth:     auth,
-			RefSpecs: []gitConfig.RefSpec{"refs/*:refs/*"},
-		}); err != nil && err != git.NoErrAlreadyUpToDate {
-			log.Fatalf("❌ Failed determining whether branch is merged or not : %v", err)
+		var (
+			merged bool
+			err    error
+		)
+		if forge != nil && prNumber > 0 {
+			merged, err = forge.IsPullRequestMerged(ctx, prNumber)
+		} else {
+			merged, err = isBranchMerged(ctx, repo, defaultBranchName, commitHash, auth)
 		}
+		switch {
+		case errors.Is(err, ErrPullRequestClosed):
+			return errorf(exitCodeGit, "branch '%s' won't get merged : %w", branchToBeMerged, err)
+
+		case errors.Is(err, ErrAuth):
+			return errorf(exitCodeGit, "failed determining whether branch is merged or not : %w", err)
+
+		case ctx.Err() != nil:
+			return ctx.Err()
+
+		// The forge or the git server may be unreachable for a while, during the (possibly long) wait.
+		case err != nil:
+			logger.Warn("⚠️ Failed determining whether branch is merged or not. Retrying", "branch", branchToBeMerged, "error", err)
+			continue
+		}
+
+		if merged {
+			logger.Info("✅ Detected branch merge", "branch", branchToBeMerged)
+			return nil
+		}
+	}
+}
 
-		defaultBranchRef, err := repo.Reference(plumbing.ReferenceName("refs/heads/"+defaultBranchName), true)
+// isBranchMerged fetches the default branch, and checks whether the given commit, or the contents
+// of each k8s/<cluster> in it, made their way into the default branch.
+func isBranchMerged(ctx context.Context, repo *git.Repository, defaultBranchName string, commitHash plumbing.Hash, auth transport.AuthMethod) (bool, error) {
+	remoteDefaultBranchRefName := plumbing.NewRemoteReferenceName("origin", defaultBranchName)
+	if err := repo.FetchContext(ctx, &git.FetchOptions{
+		Auth: auth,
+		RefSpecs: []gitConfig.RefSpec{
+			gitConfig.RefSpec(fmt.Sprintf("+refs/heads/%s:%s", defaultBranchName, remoteDefaultBranchRefName)),
+		},
+	}); err != nil && err != git.NoErrAlreadyUpToDate {
+		return false, wrapGitAuthError(err)
+	}
+
+	defaultBranchRef, err := repo.Reference(remoteDefaultBranchRefName, true)
+	if err != nil {
+		return false, fmt.Errorf("failed getting default branch ref of kubeaid-config repo : %w", err)
+	}
+
+	if commitPresent, err := isCommitPresentInBranch(repo, commitHash, defaultBranchRef.Hash()); err != nil || commitPresent {
+		return commitPresent, err
+	}
+
+	// Squash and rebase merges create new commits. So we compare the contents of the cluster dirs
+	// instead.
+	for _, clusterName := range getClusterNames() {
+		clusterDirPath := fmt.Sprintf("k8s/%s", clusterName)
+		branchClusterDirHash, err := getTreeHash(repo, commitHash, clusterDirPath)
 		if err != nil {
-			log.Fatalf("❌ Failed to get default branch ref of kubeaid-config repo : %v", err)
+			return false, err
+		}
+		defaultBranchClusterDirHash, err := getTreeHash(repo, defaultBranchRef.Hash(), clusterDirPath)
+		if err == object.ErrDirectoryNotFound {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if branchClusterDirHash != defaultBranchClusterDirHash {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// getTreeHash returns the hash of the tree at the given path, in the given commit.
+func getTreeHash(repo *git.Repository, commitHash plumbing.Hash, path string) (plumbing.Hash, error) {
+	commit, err := repo.CommitObject(commitHash)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	rootTree, err := commit.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	tree, err := rootTree.Tree(path)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return tree.Hash, nil
+}
+
+// ensureNoPlaintextSecretsStaged returns an error, if any staged manifest under the k8s/<cluster>
+// dirs is a Kubernetes Secret (instead of a Sealed Secret).
+//
+// NOTE : The Kubernetes Secrets generated by the kube-prometheus build script (listed in
+// kubePrometheusGeneratedSecrets) are ignored.
+func ensureNoPlaintextSecretsStaged(workTree *git.Worktree, status git.Status) error {
+	for filePath, fileStatus := range status {
+		if fileStatus.Staging == git.Unmodified || fileStatus.Staging == git.Deleted {
+			continue
+		}
+		if !shouldCheckForPlaintextSecrets(filePath) {
+			continue
+		}
+		if ext := filepath.Ext(filePath); ext != ".yaml" && ext != ".yml" && ext != ".json" {
+			continue
 		}
 
-		if commitPresent := isCommitPresentInBranch(repo, commitHash, defaultBranchRef.Hash()); commitPresent {
-			log.Printf("✅ Detected branch merge")
-			return
+		file, err := workTree.Filesystem.Open(filePath)
+		if err != nil {
+			return err
+		}
+		secretNames, err := getKubernetesSecretNames(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed parsing %s : %w", filePath, err)
+		}
+		for _, secretName := range secretNames {
+			if !isKubePrometheusGeneratedSecret(filePath, secretName) {
+				return fmt.Errorf("%s contains plaintext Kubernetes Secret %s", filePath, secretName)
+			}
 		}
 	}
+	return nil
 }
 
-func copyFile(sourceFile, destinationFile string) error {
-	src, err := os.Open(sourceFile)
+// Kubernetes Secrets generated by the kube-prometheus build script, by the name of the file they're
+// generated in. They contain the Grafana and Alertmanager configs the build renders. Any other
+// Kubernetes Secret in the kube-prometheus dir is refused, like anywhere else in the cluster dir.
+var kubePrometheusGeneratedSecrets = map[string]string{
+	"alertmanager-secret.yaml":          "alertmanager-main",
+	"grafana-config.yaml":               "grafana-config",
+	"grafana-dashboardDatasources.yaml": "grafana-datasources",
+}
+
+// shouldCheckForPlaintextSecrets returns whether the given path (relative to the kubeaid-config
+// repo) lies in one of the k8s/<cluster> dirs.
+func shouldCheckForPlaintextSecrets(filePath string) bool {
+	for _, clusterName := range getClusterNames() {
+		if strings.HasPrefix(filePath, fmt.Sprintf("k8s/%s/", clusterName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isKubePrometheusGeneratedSecret returns whether the Kubernetes Secret with the given name, in the
+// given file (relative to the kubeaid-config repo), is one generated by the kube-prometheus build
+// script.
+func isKubePrometheusGeneratedSecret(filePath, secretName string) bool {
+	for _, clusterName := range getClusterNames() {
+		if strings.HasPrefix(filePath, fmt.Sprintf("k8s/%s/kube-prometheus/", clusterName)) {
+			return kubePrometheusGeneratedSecrets[path.Base(filePath)] == secretName
+		}
+	}
+	return false
+}
+
+// getKubernetesSecretNames returns the names of the Kubernetes Secrets, among the YAML documents
+// read from reader.
+func getKubernetesSecretNames(reader io.Reader) ([]string, error) {
+	var secretNames []string
+	decoder := yaml.NewDecoder(reader)
+	for {
+		manifest := struct {
+			Kind     string `yaml:"kind"`
+			Metadata struct {
+				Name string `yaml:"name"`
+			} `yaml:"metadata"`
+		}{}
+		err := decoder.Decode(&manifest)
+		if err == io.EOF {
+			return secretNames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if manifest.Kind == "Secret" {
+			secretNames = append(secretNames, manifest.Metadata.Name)
+		}
+	}
+}
+
+// copyFile copies sourceFile from sourceFS to destinationFile.
+func copyFile(sourceFS fs.FS, sourceFile, destinationFile string) error {
+	src, err := sourceFS.Open(sourceFile)
 	if err != nil {
 		return err
 	}
@@ -194,11 +434,11 @@ func copyFile(sourceFile, destinationFile string) error {
 	return nil
 }
 
-func isCommitPresentInBranch(repo *git.Repository, commitHash, branchHash plumbing.Hash) bool {
+func isCommitPresentInBranch(repo *git.Repository, commitHash, branchHash plumbing.Hash) (bool, error) {
 	// Iterate through the commit history of the branch
 	commits, err := repo.Log(&git.LogOptions{From: branchHash})
 	if err != nil {
-		log.Fatalf("Failed git logging : %v", err)
+		return false, fmt.Errorf("failed git logging : %w", err)
 	}
 
 	for {
@@ -208,17 +448,34 @@ func isCommitPresentInBranch(repo *git.Repository, commitHash, branchHash plumbi
 		}
 
 		if c.Hash == commitHash {
-			return true
+			return true, nil
 		}
 	}
 
-	return false
+	return false, nil
+}
+
+func readFile(filePath string) (string, error) {
+	contents, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", errorf(exitCodeConfig, "failed reading file %s : %w", filePath, err)
+	}
+	return string(contents), nil
 }
 
-func encodeStringToBase64(input string) string {
-	data := []byte(input)
-	encodedString := base64.StdEncoding.EncodeToString(data)
-	return encodedString
+func marshalYAML(value any) ([]byte, error) {
+	output := &bytes.Buffer{}
+
+	encoder := yaml.NewEncoder(output)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	return output.Bytes(), nil
 }
 
 func parseCommand(command string) *exec.Cmd {
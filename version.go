@@ -0,0 +1,18 @@
+package main
+
+import "runtime/debug"
+
+// Version of the script. Set at build time, using -ldflags "-X main.version=<version>".
+var version string
+
+// getVersion returns the version of the script. Unless set at build time, it's the module version
+// (when installed using go install), or else dev.
+func getVersion() string {
+	if len(version) > 0 {
+		return version
+	}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok && len(buildInfo.Main.Version) > 0 && buildInfo.Main.Version != "(devel)" {
+		return buildInfo.Main.Version
+	}
+	return "dev"
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// YAMLMergeConflict is a field changed differently by the user and the template, since the file
+// was generated.
+type YAMLMergeConflict struct {
+	File string
+	Path string
+
+	// Values of the field, formatted as YAML. Empty if the field doesn't exist.
+	Base, Current, New string
+}
+
+func (c YAMLMergeConflict) Error() string {
+	return fmt.Sprintf("%s : %s : originally generated as %s, changed by you to %s, but by the template to %s",
+		c.File, c.Path, formatYAMLMergeConflictValue(c.Base), formatYAMLMergeConflictValue(c.Current), formatYAMLMergeConflictValue(c.New))
+}
+
+func formatYAMLMergeConflictValue(value string) string {
+	if len(value) == 0 {
+		return "<absent>"
+	}
+	return fmt.Sprintf("'%s'", value)
+}
+
+// mergeYAML does a three-way merge of YAML documents : the one originally generated (base), the one
+// edited by the user since (current) and the newly generated one. Changes made to a field on only
+// one side are kept. Fields changed differently on both sides are returned as conflicts. Comments
+// and formatting of the current document are preserved.
+func mergeYAML(base, current, new []byte) ([]byte, []YAMLMergeConflict, error) {
+	baseDocument, currentDocument, newDocument := &yaml.Node{}, &yaml.Node{}, &yaml.Node{}
+	for document, contents := range map[*yaml.Node][]byte{baseDocument: base, currentDocument: current, newDocument: new} {
+		if err := yaml.Unmarshal(contents, document); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	conflicts := []YAMLMergeConflict{}
+	merged := mergeYAMLNodes(getYAMLDocumentRoot(baseDocument), getYAMLDocumentRoot(currentDocument), getYAMLDocumentRoot(newDocument), "", &conflicts)
+	if len(conflicts) > 0 {
+		return nil, conflicts, nil
+	}
+	if merged == nil {
+		return nil, nil, nil
+	}
+
+	// Keep the current document's head / foot comments.
+	if currentDocument.Kind != yaml.DocumentNode {
+		currentDocument = &yaml.Node{Kind: yaml.DocumentNode}
+	}
+	currentDocument.Content = []*yaml.Node{merged}
+
+	mergedContents, err := marshalYAML(currentDocument)
+	return mergedContents, nil, err
+}
+
+// yamlContentsEqual returns whether the given YAML documents are semantically equal.
+func yamlContentsEqual(a, b []byte) bool {
+	aDocument, bDocument := &yaml.Node{}, &yaml.Node{}
+	if yaml.Unmarshal(a, aDocument) != nil || yaml.Unmarshal(b, bDocument) != nil {
+		return false
+	}
+	return yamlNodesEqual(getYAMLDocumentRoot(aDocument), getYAMLDocumentRoot(bDocument))
+}
+
+func getYAMLDocumentRoot(document *yaml.Node) *yaml.Node {
+	if document.Kind != yaml.DocumentNode || len(document.Content) == 0 {
+		return nil
+	}
+	return document.Content[0]
+}
+
+// mergeYAMLNodes three-way merges the given nodes, any of which can be nil (when the field doesn't
+// exist). A nil node is returned when the merged field shouldn't exist.
+func mergeYAMLNodes(base, current, new *yaml.Node, path string, conflicts *[]YAMLMergeConflict) *yaml.Node {
+	switch {
+	case yamlNodesEqual(current, new):
+		return current
+
+	// Only the template has changed.
+	case yamlNodesEqual(base, current):
+		return new
+
+	// Only the user has changed it.
+	case yamlNodesEqual(base, new):
+		return current
+
+	case isYAMLMapping(current) && isYAMLMapping(new):
+		return mergeYAMLMappings(base, current, new, path, conflicts)
+
+	default:
+		if len(path) == 0 {
+			path = "(root)"
+		}
+		*conflicts = append(*conflicts, YAMLMergeConflict{
+			Path:    path,
+			Base:    formatYAMLNode(base),
+			Current: formatYAMLNode(current),
+			New:     formatYAMLNode(new),
+		})
+		return current
+	}
+}
+
+func mergeYAMLMappings(base, current, new *yaml.Node, path string, conflicts *[]YAMLMergeConflict) *yaml.Node {
+	if !isYAMLMapping(base) {
+		base = nil
+	}
+
+	// Keys keep the order they have in the current mapping. Keys added by the template come last.
+	keyNodes := []*yaml.Node{}
+	for i := 0; i+1 < len(current.Content); i += 2 {
+		keyNodes = append(keyNodes, current.Content[i])
+	}
+	for i := 0; i+1 < len(new.Content); i += 2 {
+		if getYAMLMappingValue(current, new.Content[i].Value) == nil {
+			keyNodes = append(keyNodes, new.Content[i])
+		}
+	}
+
+	merged := *current
+	merged.Content = nil
+	for _, keyNode := range keyNodes {
+		key := keyNode.Value
+		mergedValue := mergeYAMLNodes(
+			getYAMLMappingValue(base, key), getYAMLMappingValue(current, key), getYAMLMappingValue(new, key),
+			strings.TrimPrefix(path+"."+key, "."), conflicts,
+		)
+		if mergedValue != nil {
+			merged.Content = append(merged.Content, keyNode, mergedValue)
+		}
+	}
+	return &merged
+}
+
+func isYAMLMapping(node *yaml.Node) bool {
+	return node != nil && node.Kind == yaml.MappingNode
+}
+
+func getYAMLMappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if !isYAMLMapping(mapping) {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// yamlNodesEqual compares the given nodes semantically, ignoring comments, styles and the order of
+// mapping keys.
+func yamlNodesEqual(a, b *yaml.Node) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Kind == yaml.AliasNode {
+		return yamlNodesEqual(a.Alias, b)
+	}
+	if b.Kind == yaml.AliasNode {
+		return yamlNodesEqual(a, b.Alias)
+	}
+	if a.Kind != b.Kind || len(a.Content) != len(b.Content) {
+		return false
+	}
+
+	switch a.Kind {
+	case yaml.ScalarNode:
+		return a.ShortTag() == b.ShortTag() && a.Value == b.Value
+
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(a.Content); i += 2 {
+			if !yamlNodesEqual(a.Content[i+1], getYAMLMappingValue(b, a.Content[i].Value)) {
+				return false
+			}
+		}
+		return true
+
+	default:
+		for i := range a.Content {
+			if !yamlNodesEqual(a.Content[i], b.Content[i]) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func formatYAMLNode(node *yaml.Node) string {
+	if node == nil {
+		return ""
+	}
+	formatted, err := yaml.Marshal(node)
+	if err != nil {
+		return node.Value
+	}
+	return strings.TrimSpace(string(formatted))
+}